@@ -2,16 +2,28 @@ package blackbaud
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"maps"
 	"net/http"
 	"net/url"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/BushSchoolIT/extractor/envconfig"
+	"github.com/BushSchoolIT/extractor/metrics"
+	"github.com/BushSchoolIT/extractor/secrets"
+	"github.com/BushSchoolIT/extractor/tracing"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/time/rate"
 )
 
@@ -39,6 +51,16 @@ type BBAPIConnector struct {
 	Client     *http.Client
 	EndYear    int
 	StartYear  int
+	stats      map[string]ListStats
+	statsLock  sync.Mutex
+	// when set, every fetched page is checkpointed
+	Checkpoints PageStore
+	// continue lists from their checkpointed pages instead of the first page
+	Resume bool
+	// when set, the raw JSON of every fetched page is kept
+	RawPages RawPageSink
+	// when set, pages are read from here instead of the API
+	Source PageSource
 }
 
 type Column struct {
@@ -105,8 +127,12 @@ func NewBBApiConnector(configPath string) (*BBAPIConnector, error) {
 	if err != nil {
 		return nil, err
 	}
+	return newConnector(configPath, config, false)
+}
 
-	client := &http.Client{}
+// refreshed is set once the tokens have been refreshed, a second 401 fails instead of refreshing again
+func newConnector(configPath string, config Config, refreshed bool) (*BBAPIConnector, error) {
+	client := &http.Client{Transport: metrics.Transport(nil)}
 	connector := &BBAPIConnector{
 		&config,
 		configPath,
@@ -115,6 +141,12 @@ func NewBBApiConnector(configPath string) (*BBAPIConnector, error) {
 		client,
 		0,
 		0,
+		nil,
+		sync.Mutex{},
+		nil,
+		false,
+		nil,
+		nil,
 	}
 	req, err := connector.NewRequest(http.MethodGet, config.Other.TestApiEndpoint, nil /* body */)
 	if err != nil {
@@ -127,18 +159,35 @@ func NewBBApiConnector(configPath string) (*BBAPIConnector, error) {
 	body, _ := io.ReadAll(resp.Body)
 	switch resp.StatusCode {
 	case http.StatusUnauthorized:
+		if refreshed {
+			return nil, fmt.Errorf("still unauthorized after refreshing the auth token, response body: %s", string(body))
+		}
 		err = refreshToken(&config)
 		if err != nil {
 			return nil, err
 		}
-		err = saveConfig(configPath, config)
+		// only the new tokens are saved, to the files they reference if they do, environment overrides stay out of the file
+		saved, err := readConfig(configPath)
+		if err != nil {
+			return nil, err
+		}
+		saved.Tokens.AccessToken, err = secrets.Update(saved.Tokens.AccessToken, config.Tokens.AccessToken)
+		if err != nil {
+			return nil, err
+		}
+		saved.Tokens.RefreshToken, err = secrets.Update(saved.Tokens.RefreshToken, config.Tokens.RefreshToken)
+		if err != nil {
+			return nil, err
+		}
+		err = saveConfig(configPath, saved)
 		if err != nil {
 			return nil, err
 		}
 
-		return NewBBApiConnector(configPath)
+		// reloading would bring the expired token back from an env: reference or a BBEXTRACT_AUTH_* override
+		return newConnector(configPath, config, true)
 	case http.StatusOK:
-		end, start, err := getYears(connector)
+		start, end, err := getYears(connector)
 		if err != nil {
 			return nil, err
 		}
@@ -166,7 +215,7 @@ func refreshToken(config *Config) error {
 		return err
 	}
 
-	client := &http.Client{}
+	client := &http.Client{Transport: metrics.Transport(nil)}
 	resp, err := client.Do(req)
 	if err != nil {
 		return err
@@ -196,8 +245,28 @@ func refreshToken(config *Config) error {
 	return resp.Body.Close()
 }
 
-func (b *BBAPIConnector) GetAdvancedList(id string, page int) (AdvancedList, error) {
-	req, err := b.NewRequest(http.MethodGet, AdvancedListApi(id, page), nil)
+// params are passed to the list as runtime parameters (filters), nil for none
+func (b *BBAPIConnector) GetAdvancedList(ctx context.Context, id string, page int, params url.Values) (parsed AdvancedList, err error) {
+	ctx, span := tracing.Start(ctx, "page", attribute.String("list_id", id), attribute.Int("page", page))
+	defer func() {
+		span.SetAttributes(attribute.Int("rows", len(parsed.Results.Rows)))
+		tracing.End(span, err)
+	}()
+	if b.Source != nil {
+		span.SetAttributes(attribute.Bool("stored", true))
+		body, err := b.Source.Page(id, page)
+		if err != nil {
+			return AdvancedList{}, fmt.Errorf("Unable to read stored page: %v", err)
+		}
+		if body == nil {
+			return parsed, nil // past the last stored page
+		}
+		if err := json.Unmarshal(body, &parsed); err != nil {
+			return AdvancedList{}, fmt.Errorf("JSON unmarshal failed: %v", err)
+		}
+		return parsed, nil
+	}
+	req, err := b.NewRequestContext(ctx, http.MethodGet, AdvancedListApi(id, page, params), nil)
 	if err != nil {
 		return AdvancedList{}, fmt.Errorf("Unable to create request: %v", err)
 	}
@@ -205,24 +274,83 @@ func (b *BBAPIConnector) GetAdvancedList(id string, page int) (AdvancedList, err
 	if err != nil {
 		return AdvancedList{}, fmt.Errorf("Unable to access blackbaud api: %v", err)
 	}
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
 	body, err := io.ReadAll(resp.Body)
 	if resp.StatusCode != http.StatusOK {
 		return AdvancedList{}, fmt.Errorf("Blackbaud API returned unexpected status code, code: %d, body: %s", resp.StatusCode, string(body))
 	}
 
-	var parsed AdvancedList
 	if err := json.Unmarshal(body, &parsed); err != nil {
 		return AdvancedList{}, fmt.Errorf("JSON unmarshal failed: %v", err)
 	}
+	if b.RawPages != nil {
+		err = b.RawPages.SaveRawPage(id, params, page, body)
+		if err != nil {
+			return AdvancedList{}, fmt.Errorf("Unable to store raw page: %v", err)
+		}
+	}
 	return parsed, resp.Body.Close()
 }
 
+// keeps the raw JSON of every page fetched from the API
+type RawPageSink interface {
+	SaveRawPage(id string, params url.Values, page int, body []byte) error
+}
+
+// serves list pages stored by an earlier run, a nil body means the page doesn't exist
+type PageSource interface {
+	Page(id string, page int) ([]byte, error)
+}
+
+/*
+A connector that never touches the network, advanced lists are read from pages stored by an earlier run.
+Used to rerun the load and transforms after fixing a bug without hitting the API again.
+*/
+func NewOfflineConnector(source PageSource, startYear int, endYear int) *BBAPIConnector {
+	return &BBAPIConnector{
+		ctx:       context.Background(),
+		limiter:   rate.NewLimiter(rate.Inf, 1),
+		Client:    &http.Client{},
+		StartYear: startYear,
+		EndYear:   endYear,
+		Source:    source,
+	}
+}
+
+// a connector for another job sharing this one's token, HTTP client and rate limiter, but not its stores or stats
+func (b *BBAPIConnector) Share() *BBAPIConnector {
+	return &BBAPIConnector{
+		config:     b.config,
+		configPath: b.configPath,
+		ctx:        b.ctx,
+		limiter:    b.limiter,
+		Client:     b.Client,
+		StartYear:  b.StartYear,
+		EndYear:    b.EndYear,
+		Source:     b.Source,
+	}
+}
+
+// the connector's context, the parent of its spans
+func (b *BBAPIConnector) SetContext(ctx context.Context) {
+	b.ctx = ctx
+}
+
 func (b *BBAPIConnector) NewRequest(method string, url string, body io.Reader) (*http.Request, error) {
-	err := b.limiter.Wait(b.ctx)
+	return b.NewRequestContext(b.ctx, method, url, body)
+}
+
+// same as NewRequest, waiting on the rate limiter and sending the request within ctx
+func (b *BBAPIConnector) NewRequestContext(ctx context.Context, method string, url string, body io.Reader) (*http.Request, error) {
+	start := time.Now()
+	_, span := tracing.Start(ctx, "rate limit wait")
+	err := b.limiter.Wait(ctx)
+	tracing.End(span, err)
+	metrics.Since(metrics.RateLimitWait, start)
 	if err != nil {
 		return nil, err
 	}
-	req, err := http.NewRequest(method, url, body)
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
 
 	if err != nil {
 		return req, err
@@ -235,12 +363,22 @@ func (b *BBAPIConnector) NewRequest(method string, url string, body io.Reader) (
 	return req, nil
 }
 
-func loadConfig(configPath string) (Config, error) {
+// environment variables overriding auth file fields start with this, e.g. BBEXTRACT_AUTH_SKY_APP_INFORMATION_APP_SECRET
+const ENV_PREFIX string = "BBEXTRACT_AUTH"
+
+// the fields holding secrets, each of which may be a secret reference
+func (c *Config) secrets() []*string {
+	return []*string{&c.Other.ApiSubscriptionKey, &c.Tokens.AccessToken, &c.Tokens.RefreshToken, &c.SkyAppInformation.AppSecret}
+}
+
+// the auth file as it is on disk, without environment overrides or resolved secrets
+func readConfig(configPath string) (Config, error) {
 	var config Config
 	f, err := os.Open(configPath)
 	if err != nil {
 		return config, err
 	}
+	defer f.Close()
 	data, err := io.ReadAll(f)
 	if err != nil {
 		return config, err
@@ -252,6 +390,52 @@ func loadConfig(configPath string) (Config, error) {
 	return config, nil
 }
 
+/*
+Reads the auth file, applies BBEXTRACT_AUTH_* overrides, resolves secret references such as
+env:BB_APP_SECRET or file:/run/secrets/bb_app_secret and checks the fields needed to call the API are set.
+*/
+func loadConfig(configPath string) (Config, error) {
+	config, err := readConfig(configPath)
+	if err != nil {
+		return config, err
+	}
+	_, err = envconfig.Apply(ENV_PREFIX, &config)
+	if err != nil {
+		return config, err
+	}
+	for _, secret := range config.secrets() {
+		*secret, err = secrets.Resolve(*secret)
+		if err != nil {
+			return config, err
+		}
+		// keys and tokens are random, even written out in the file they can't be mistaken for other text
+		secrets.Register(*secret)
+	}
+	missing := []string{}
+	for field, value := range map[string]string{
+		"other.api_subscription_key":     config.Other.ApiSubscriptionKey,
+		"other.test_api_endpoint":        config.Other.TestApiEndpoint,
+		"tokens.refresh_token":           config.Tokens.RefreshToken,
+		"sky_app_information.app_id":     config.SkyAppInformation.AppID,
+		"sky_app_information.app_secret": config.SkyAppInformation.AppSecret,
+	} {
+		if value == "" {
+			missing = append(missing, field)
+		}
+	}
+	if len(missing) > 0 {
+		slices.Sort(missing)
+		return config, fmt.Errorf("%s is missing %s", configPath, strings.Join(missing, ", "))
+	}
+	return config, nil
+}
+
+// an error if the auth file can't be read or lacks what's needed to call the API
+func CheckConfig(configPath string) error {
+	_, err := loadConfig(configPath)
+	return err
+}
+
 func saveConfig(configPath string, config Config) error {
 	const filePerm = 0644
 
@@ -318,43 +502,271 @@ func getYears(connector *BBAPIConnector) (int, int, error) {
 	return beginTime.Year(), endTime.Year(), resp.Body.Close()
 }
 
-func AdvancedListApi(id string, page int) string {
-	return fmt.Sprintf("%s/%s?page=%d", LISTS_API, id, page)
+func AdvancedListApi(id string, page int, params url.Values) string {
+	query := url.Values{}
+	for k, v := range params {
+		query[k] = v
+	}
+	query.Set("page", strconv.Itoa(page))
+	return fmt.Sprintf("%s/%s?%s", LISTS_API, id, query.Encode())
 }
 
 // Thin Datastructure used for processing and inserting into the DB :)
 type UnorderedTable struct {
 	Columns []string
 	Rows    [][]any
+	// columns only some of the merged tables had, the other tables' rows hold null for them
+	Partial []string
 }
 
+// how many times a list is read before giving up on it not matching its reported total
+const LIST_ATTEMPTS int = 3
+
+// expected versus collected rows for a list, recorded in the logs and the run summary
+type ListStats struct {
+	ID       string `json:"id"`
+	Expected int    `json:"expected"`
+	Actual   int    `json:"actual"`
+	Pages    int    `json:"pages"`
+	Attempts int    `json:"attempts"`
+}
+
+/*
+Reads every page of an advanced list. The number of rows collected is checked against the total
+blackbaud reports so a transient empty page can't silently cut the list short, a mismatch rereads the
+whole list up to LIST_ATTEMPTS times before failing.
+*/
 func ProcessList(api *BBAPIConnector, id string) (UnorderedTable, error) {
+	return ProcessFilteredList(api, id, nil)
+}
+
+// same as ProcessList, with runtime parameters for lists that support filters
+func ProcessFilteredList(api *BBAPIConnector, id string, params url.Values) (UnorderedTable, error) {
+	stats := ListStats{ID: id}
+	log := listLogger(id)
+	ctx, span := tracing.Start(api.ctx, "list", attribute.String("list_id", id))
+	var err error
+	defer func() {
+		api.recordStats(stats)
+		span.SetAttributes(attribute.Int("expected", stats.Expected), attribute.Int("actual", stats.Actual), attribute.Int("pages", stats.Pages))
+		tracing.End(span, err)
+	}()
+	for attempt := 1; attempt <= LIST_ATTEMPTS; attempt++ {
+		stats.Attempts = attempt
+		name := "read list"
+		if attempt > 1 {
+			name = "retry list"
+		}
+		attemptCtx, attemptSpan := tracing.Start(ctx, name, attribute.String("list_id", id), attribute.Int("attempt", attempt))
+		var t UnorderedTable
+		// a retry starts from scratch, the checkpointed pages are what didn't add up
+		t, err = readList(attemptCtx, api, id, params, &stats, api.Resume && attempt == 1)
+		tracing.End(attemptSpan, err)
+		if err == nil {
+			log.Info("Collected list", slog.Int("expected", stats.Expected), slog.Int("actual", stats.Actual), slog.Int("pages", stats.Pages))
+			return t, nil
+		}
+		if !errors.Is(err, ErrIncompleteList) {
+			return t, err
+		}
+		log.Warn("List is incomplete, rereading it", slog.Int("expected", stats.Expected), slog.Int("actual", stats.Actual), slog.Int("attempt", attempt))
+	}
+	log.Error("List is still incomplete after retrying", slog.Int("expected", stats.Expected), slog.Int("actual", stats.Actual))
+	return UnorderedTable{}, err
+}
+
+// tags every record logged while reading a list with its ID
+func listLogger(id string) *slog.Logger {
+	return slog.With(slog.String("list_id", id))
+}
+
+var ErrIncompleteList = errors.New("list rows do not match the reported total")
+
+/*
+Persists fetched pages of the lists a run reads, so a run that failed partway through can pick up
+from the last completed page instead of refetching every list.
+*/
+type PageStore interface {
+	// the pages stored for a list read with params, in order, and whether the list was read to the end
+	LoadPages(id string, params url.Values) ([]AdvancedList, bool, error)
+	SavePage(id string, params url.Values, page int, list AdvancedList) error
+	CompleteList(id string, params url.Values) error
+	ClearList(id string, params url.Values) error
+}
+
+func readList(ctx context.Context, api *BBAPIConnector, id string, params url.Values, stats *ListStats, resume bool) (UnorderedTable, error) {
 	t := UnorderedTable{}
-	for page := 1; ; page++ {
-		parsed, err := api.GetAdvancedList(id, page)
-		if err != nil {
-			slog.Error("Unable to get advanced list", slog.String("id", id), slog.Int("page", page))
-			return t, fmt.Errorf("Unable to get advanced list, id: %s, err: %v", id, err)
+	log := listLogger(id)
+	stats.Expected, stats.Actual, stats.Pages = 0, 0, 0
+	// adds a page to t, returning whether it was the last one
+	addPage := func(page int, parsed AdvancedList) bool {
+		if page == 1 {
+			stats.Expected = parsed.Paging.TotalRows
 		}
 		if len(parsed.Results.Rows) == 0 {
-			break // No more data
+			return true // No more data
 		}
+		stats.Pages = page
+		metrics.ListPages.WithLabelValues(id).Inc()
+		metrics.ListRows.WithLabelValues(id).Add(float64(len(parsed.Results.Rows)))
 		if len(t.Columns) == 0 {
 			t.Columns = GetColumns(parsed.Results.Rows[0])
 		}
-
-		slog.Info("Collecting Data From Page", slog.Int("page", page), slog.String("id", id))
 		for _, row := range parsed.Results.Rows {
-			newRow := []any{}
-			for _, col := range row.Columns {
-				newRow = append(newRow, col.Value)
+			t.Rows = append(t.Rows, alignRow(t.Columns, row))
+		}
+		stats.Actual = len(t.Rows)
+		// paging is only trusted when blackbaud filled it in
+		return parsed.Paging.TotalRows > 0 && parsed.Paging.RemainingRows == 0
+	}
+
+	start, done := 1, false
+	if api.Checkpoints != nil && resume {
+		pages, complete, err := api.Checkpoints.LoadPages(id, params)
+		if err != nil {
+			return t, fmt.Errorf("Unable to load checkpointed pages, id: %s, err: %v", id, err)
+		}
+		for i, parsed := range pages {
+			// the run keeps the resumed pages too, or reprocessing it would find its lists cut short
+			if api.RawPages != nil {
+				body, err := json.Marshal(parsed)
+				if err == nil {
+					err = api.RawPages.SaveRawPage(id, params, i+1, body)
+				}
+				if err != nil {
+					return t, fmt.Errorf("Unable to store checkpointed raw page, id: %s, page: %d, err: %v", id, i+1, err)
+				}
 			}
-			t.Rows = append(t.Rows, newRow)
+			done = addPage(i+1, parsed)
+		}
+		done = done || complete
+		start = len(pages) + 1
+		if len(pages) > 0 {
+			log.Info("Resuming list from checkpoint", slog.Int("pages", len(pages)), slog.Bool("complete", done))
+		}
+	} else if api.Checkpoints != nil {
+		err := api.Checkpoints.ClearList(id, params)
+		if err != nil {
+			return t, fmt.Errorf("Unable to clear checkpointed pages, id: %s, err: %v", id, err)
+		}
+	}
+	for page := start; !done; page++ {
+		parsed, err := api.GetAdvancedList(ctx, id, page, params)
+		if err != nil {
+			log.Error("Unable to get advanced list", slog.Int("page", page))
+			return t, fmt.Errorf("Unable to get advanced list, id: %s, err: %v", id, err)
+		}
+		if api.Checkpoints != nil && len(parsed.Results.Rows) > 0 {
+			err = api.Checkpoints.SavePage(id, params, page, parsed)
+			if err != nil {
+				return t, fmt.Errorf("Unable to checkpoint page, id: %s, page: %d, err: %v", id, page, err)
+			}
+		}
+		if len(parsed.Results.Rows) > 0 {
+			log.Info("Collecting Data From Page", slog.Int("page", page))
+		}
+		done = addPage(page, parsed)
+	}
+	if stats.Expected > 0 && stats.Actual != stats.Expected {
+		return t, fmt.Errorf("id: %s, expected %d rows, got %d: %w", id, stats.Expected, stats.Actual, ErrIncompleteList)
+	}
+	if api.Checkpoints != nil {
+		err := api.Checkpoints.CompleteList(id, params)
+		if err != nil {
+			return t, fmt.Errorf("Unable to mark list as complete, id: %s, err: %v", id, err)
 		}
 	}
 	return t, nil
 }
 
+func (b *BBAPIConnector) recordStats(stats ListStats) {
+	b.statsLock.Lock()
+	defer b.statsLock.Unlock()
+	if b.stats == nil {
+		b.stats = map[string]ListStats{}
+	}
+	b.stats[stats.ID] = stats
+}
+
+// stats of every list read so far, keyed by list ID
+func (b *BBAPIConnector) ListStats() map[string]ListStats {
+	b.statsLock.Lock()
+	defer b.statsLock.Unlock()
+	return maps.Clone(b.stats)
+}
+
+// row values in the order of columns, matched by name when the row's columns are in a different order
+func alignRow(columns []string, row Row) []any {
+	newRow := make([]any, len(columns))
+	if slices.Equal(columns, GetColumns(row)) {
+		for i, col := range row.Columns {
+			newRow[i] = col.Value
+		}
+		return newRow
+	}
+	for _, col := range row.Columns {
+		if i := slices.Index(columns, col.Name); i != -1 {
+			newRow[i] = col.Value
+		}
+	}
+	return newRow
+}
+
+// identifies a list's column set and order, changes when blackbaud's list definition does
+func Fingerprint(columns []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(columns, "\x1f")))
+	return hex.EncodeToString(sum[:])
+}
+
+/*
+Combines tables that are supposed to share a layout. Rows are realigned by column name onto the
+columns of the first table, followed by any column only later tables have, so nothing is dropped.
+Values a table has no column for are left null and the column is listed in Partial.
+*/
+func Merge(tables ...UnorderedTable) UnorderedTable {
+	merged := UnorderedTable{}
+	for _, t := range tables {
+		for _, col := range t.Columns {
+			if slices.Contains(merged.Columns, col) {
+				continue
+			}
+			if len(merged.Rows) > 0 {
+				slog.Warn("Adding column missing from the earlier lists", slog.String("column", col))
+			}
+			merged.Columns = append(merged.Columns, col)
+			for i := range merged.Rows {
+				merged.Rows[i] = append(merged.Rows[i], nil)
+			}
+		}
+		if slices.Equal(merged.Columns, t.Columns) {
+			merged.Rows = append(merged.Rows, t.Rows...)
+			continue
+		}
+		index := make([]int, len(merged.Columns))
+		for i, col := range merged.Columns {
+			index[i] = slices.Index(t.Columns, col)
+		}
+		for _, row := range t.Rows {
+			newRow := make([]any, len(merged.Columns))
+			for i, j := range index {
+				if j != -1 {
+					newRow[i] = row[j]
+				}
+			}
+			merged.Rows = append(merged.Rows, newRow)
+		}
+	}
+	for _, col := range merged.Columns {
+		for _, t := range tables {
+			if len(t.Rows) > 0 && !slices.Contains(t.Columns, col) {
+				merged.Partial = append(merged.Partial, col)
+				break
+			}
+		}
+	}
+	return merged
+}
+
 func GetColumns(row Row) []string {
 	columns := []string{}
 	for _, col := range row.Columns {
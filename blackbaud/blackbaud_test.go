@@ -0,0 +1,44 @@
+package blackbaud
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestMergeMissingColumn(t *testing.T) {
+	first := UnorderedTable{Columns: []string{"id", "grade", "comment"}, Rows: [][]any{{1, "A", "good"}}}
+	second := UnorderedTable{Columns: []string{"grade", "id"}, Rows: [][]any{{"B", 2}}}
+	merged := Merge(first, second)
+	if !slices.Equal(merged.Columns, []string{"id", "grade", "comment"}) {
+		t.Fatalf("columns = %v", merged.Columns)
+	}
+	if !slices.Equal(merged.Rows[1], []any{2, "B", nil}) {
+		t.Errorf("second list's row = %v, want it realigned with a null comment", merged.Rows[1])
+	}
+	if !slices.Equal(merged.Partial, []string{"comment"}) {
+		t.Errorf("partial = %v, want [comment]", merged.Partial)
+	}
+}
+
+func TestMergeExtraColumn(t *testing.T) {
+	first := UnorderedTable{Columns: []string{"id", "grade"}, Rows: [][]any{{1, "A"}}}
+	second := UnorderedTable{Columns: []string{"id", "grade", "comment"}, Rows: [][]any{{2, "B", "late"}}}
+	merged := Merge(first, second)
+	if !slices.Equal(merged.Columns, []string{"id", "grade", "comment"}) {
+		t.Fatalf("columns = %v", merged.Columns)
+	}
+	if !slices.Equal(merged.Rows[0], []any{1, "A", nil}) || !slices.Equal(merged.Rows[1], []any{2, "B", "late"}) {
+		t.Errorf("rows = %v", merged.Rows)
+	}
+	if !slices.Equal(merged.Partial, []string{"comment"}) {
+		t.Errorf("partial = %v, want [comment]", merged.Partial)
+	}
+}
+
+func TestMergeEmptyListIsNotPartial(t *testing.T) {
+	first := UnorderedTable{Columns: []string{"id", "grade"}, Rows: [][]any{{1, "A"}}}
+	empty := UnorderedTable{Columns: []string{"id"}}
+	if merged := Merge(first, empty); len(merged.Partial) != 0 {
+		t.Errorf("partial = %v, a list without rows left no nulls", merged.Partial)
+	}
+}
@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"log/slog"
 	"maps"
@@ -10,13 +11,12 @@ import (
 	"time"
 
 	"github.com/BushSchoolIT/extractor/blackbaud"
-	"github.com/BushSchoolIT/extractor/database"
 	"github.com/spf13/cobra"
 )
 
-func Attendance(cmd *cobra.Command, args []string) error {
+func Attendance(cmd *cobra.Command, args []string) (err error) {
 	// load config and blackbaud API
-	api, err := blackbaud.NewBBApiConnector(fAuthFile)
+	api, err := newAPI(cmd)
 	if err != nil {
 		slog.Error("Unable to access blackbaud api", slog.Any("error", err))
 		return err
@@ -26,12 +26,18 @@ func Attendance(cmd *cobra.Command, args []string) error {
 		slog.Error("Unable to load config", slog.Any("error", err))
 		return err
 	}
-	db, err := database.Connect(config.Postgres)
+	db, err := connect(cmd, config)
 	if err != nil {
 		slog.Error("Unable to connect to DB", slog.Any("error", err))
 		return err
 	}
 	defer db.Close()
+	err = db.StartRun()
+	if err != nil {
+		slog.Error("Unable to record run", slog.Any("error", err))
+		return err
+	}
+	defer func() { db.FinishRun(err) }()
 
 	t := blackbaud.UnorderedTable{}
 	for _, id := range config.Attendance.LevelIDs {
@@ -53,7 +59,7 @@ func Attendance(cmd *cobra.Command, args []string) error {
 		}
 		if resp.StatusCode != http.StatusOK {
 			slog.Error("Response returned unexpected status code", slog.String("id", id), slog.Int("code", resp.StatusCode), slog.String("body", string(body)))
-			return err
+			return fmt.Errorf("attendance for level %s returned status %d", id, resp.StatusCode)
 		}
 		parsed := blackbaud.Attendance{}
 		err = json.Unmarshal(body, &parsed)
@@ -73,10 +79,20 @@ func Attendance(cmd *cobra.Command, args []string) error {
 			t.Rows = append(t.Rows, newRow)
 		}
 	}
+	err = stage(&db)
+	if err != nil {
+		slog.Error("Unable to stage tables", slog.Any("error", err))
+		return err
+	}
+	defer db.Unstage()
 	err = db.InsertAttendance(t)
 	if err != nil {
 		slog.Error("Unable to insert emails", slog.Any("error", err))
 		return err
 	}
+	err = publish(&db, config, cmd.Name())
+	if err != nil {
+		return err
+	}
 	return nil
 }
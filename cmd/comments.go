@@ -4,13 +4,12 @@ import (
 	"log/slog"
 
 	"github.com/BushSchoolIT/extractor/blackbaud"
-	"github.com/BushSchoolIT/extractor/database"
 	"github.com/spf13/cobra"
 )
 
-func Comments(cmd *cobra.Command, args []string) error {
+func Comments(cmd *cobra.Command, args []string) (err error) {
 	// load config and blackbaud API
-	api, err := blackbaud.NewBBApiConnector(fAuthFile)
+	api, err := newAPI(cmd)
 	if err != nil {
 		slog.Error("Unable to access blackbaud api", slog.Any("error", err))
 		return err
@@ -20,26 +19,66 @@ func Comments(cmd *cobra.Command, args []string) error {
 		slog.Error("Unable to load config", slog.Any("error", err))
 		return err
 	}
-	db, err := database.Connect(config.Postgres)
+	db, err := connect(cmd, config)
 	if err != nil {
 		slog.Error("Unable to connect to DB", slog.Any("error", err))
 		return err
 	}
 	defer db.Close()
+	err = db.StartRun()
+	if err != nil {
+		slog.Error("Unable to record run", slog.Any("error", err))
+		return err
+	}
+	defer func() {
+		db.Summarize("lists", api.ListStats())
+		db.FinishRun(err)
+	}()
 	// actual logic
-	t, err := blackbaud.ProcessList(api, config.TranscriptCommentsID)
+	err = attachStores(api, &db)
+	if err != nil {
+		slog.Error("Unable to set up page storage", slog.Any("error", err))
+		return err
+	}
+	params, err := incrementalParams(&db, config, cmd.Name())
+	if err != nil {
+		slog.Error("Unable to set up incremental extraction", slog.Any("error", err))
+		return err
+	}
+	t, err := blackbaud.ProcessFilteredList(api, config.TranscriptCommentsID, params)
 	if err != nil {
 		slog.Error("Unable to complete transcript operations", slog.Any("error", err))
 		return err
 	}
+	err = db.CheckListSchema(config.TranscriptCommentsID, t.Columns)
+	if err != nil {
+		slog.Error("Transcript comments list schema drifted", slog.Any("error", err))
+		return err
+	}
 	slog.Info("Import Complete")
 
 	slog.Info("Starting Database transformations")
+	err = stage(&db)
+	if err != nil {
+		slog.Error("Unable to stage tables", slog.Any("error", err))
+		return err
+	}
+	defer db.Unstage()
 	err = db.TranscriptCommentOps(t)
 	if err != nil {
 		slog.Error("Unable to complete transcript operations", slog.Any("error", err))
 		return err
 	}
 	slog.Info("Finish Database transformations")
+	err = publish(&db, config, cmd.Name())
+	if err != nil {
+		return err
+	}
+	err = saveWatermark(&db, config, cmd.Name(), t)
+	if err != nil {
+		slog.Error("Unable to save watermark", slog.Any("error", err))
+		return err
+	}
+	clearCheckpoints(&db)
 	return nil
 }
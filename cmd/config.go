@@ -0,0 +1,236 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/BushSchoolIT/extractor/blackbaud"
+	"github.com/BushSchoolIT/extractor/database"
+	"github.com/BushSchoolIT/extractor/envconfig"
+	"github.com/BushSchoolIT/extractor/notify"
+	"github.com/BushSchoolIT/extractor/runner"
+	"github.com/BushSchoolIT/extractor/scheduler"
+	"github.com/BushSchoolIT/extractor/secrets"
+	"github.com/spf13/cobra"
+)
+
+// environment variables overriding config fields start with this, e.g. BBEXTRACT_POSTGRES_PASSWORD
+const ENV_PREFIX string = "BBEXTRACT"
+
+// blackbaud list and level IDs are numbers
+var idFormat = regexp.MustCompile(`^[0-9]+$`)
+
+// the config was read but its fields failed Check
+type configError struct {
+	err error
+}
+
+func (e configError) Error() string {
+	return fmt.Sprintf("invalid config: %v", e.err)
+}
+
+/*
+Merges the profile's fields over the config, so a profile only lists what differs from the base.
+Objects are merged field by field while lists and values replace the base's.
+*/
+func applyProfile(config *Config, profile string) error {
+	if profile == "" {
+		return nil
+	}
+	raw, ok := config.Profiles[profile]
+	if !ok {
+		return fmt.Errorf("no profile %s, profiles: %s", profile, strings.Join(slices.Sorted(maps.Keys(config.Profiles)), ", "))
+	}
+	err := json.Unmarshal(raw, config)
+	if err != nil {
+		return fmt.Errorf("profile %s: %v", profile, err)
+	}
+	return nil
+}
+
+// applies BBEXTRACT_* overrides, logging their names but never their values
+func applyEnv(config *Config) error {
+	applied, err := envconfig.Apply(ENV_PREFIX, config)
+	if err != nil {
+		return err
+	}
+	if len(applied) > 0 {
+		slog.Info("Applied config overrides from the environment", slog.Any("variables", applied))
+	}
+	return nil
+}
+
+func checkIDs(field string, ids ...string) error {
+	for _, id := range ids {
+		if !idFormat.MatchString(id) {
+			return fmt.Errorf("%s: %q is not a numeric ID", field, id)
+		}
+	}
+	return nil
+}
+
+/*
+Problems with the config that would otherwise only show up deep in a run, all of them joined.
+Fields a single job needs are checked by require instead so other jobs still run without them.
+*/
+func (c Config) Check() error {
+	errs := []error{}
+	add := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	p := c.Postgres
+	if p.User == "" || p.Addr == "" || p.Port == "" || p.Name == "" {
+		add(fmt.Errorf("postgres: user, address, port and database are required"))
+	}
+	if p.Port != "" && !idFormat.MatchString(p.Port) {
+		add(fmt.Errorf("postgres.port: %q is not a number", p.Port))
+	}
+	add(checkIDs("transcript_list_ids", c.TranscriptListIDs...))
+	add(checkIDs("attendance.level_ids", c.Attendance.LevelIDs...))
+	for field, id := range map[string]string{
+		"parents_list_id":              c.ParentsID,
+		"transcript_comments_id":       c.TranscriptCommentsID,
+		"enrollment_list_ids.departed": c.EnrollmentListIDs.Departed,
+		"enrollment_list_ids.enrolled": c.EnrollmentListIDs.Enrolled,
+	} {
+		if id != "" {
+			add(checkIDs(field, id))
+		}
+	}
+	names := map[string]bool{}
+	for _, d := range c.GpaDefinitions {
+		add(d.Validate())
+		if names[d.Name] {
+			add(fmt.Errorf("gpa definition %s is defined twice", d.Name))
+		}
+		names[d.Name] = true
+	}
+	for i, v := range c.Validations {
+		if v.Name == "" || v.Query == "" {
+			add(fmt.Errorf("validation %d needs a name and a query", i+1))
+		}
+	}
+	for job, inc := range c.Incremental {
+		if inc.Parameter == "" || inc.Column == "" {
+			add(fmt.Errorf("incremental.%s needs both a parameter and a column", job))
+		}
+	}
+	for job, sync := range c.Sync {
+		if err := sync.Validate(); err != nil {
+			add(fmt.Errorf("sync.%s: %v", job, err))
+		}
+	}
+	if c.ErrorBudget < 0 || c.Concurrency < 0 {
+		add(fmt.Errorf("error_budget and concurrency can't be negative"))
+	}
+	if c.MaxShrinkPercent < 0 || c.MaxShrinkPercent > 100 {
+		add(fmt.Errorf("max_shrink_percent must be between 0 and 100, got %v", c.MaxShrinkPercent))
+	}
+	if _, err := notify.New(c.Notifications); err != nil {
+		add(fmt.Errorf("notifications: %v", err))
+	}
+	if _, err := scheduler.New(c.Schedules, nil, nil); err != nil {
+		add(fmt.Errorf("schedules: %v", err))
+	}
+	for name, p := range c.Pipelines {
+		if err := runner.CheckDAG(p.Stages); err != nil {
+			add(fmt.Errorf("pipelines.%s: %v", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// the fields job can't run without
+func (c Config) require(job string) error {
+	missing := ""
+	switch job {
+	case "transcripts":
+		if len(c.TranscriptListIDs) == 0 {
+			missing = "transcript_list_ids"
+		}
+	case "comments":
+		if c.TranscriptCommentsID == "" {
+			missing = "transcript_comments_id"
+		}
+	case "parents":
+		if c.ParentsID == "" {
+			missing = "parents_list_id"
+		}
+	case "attendance":
+		if len(c.Attendance.LevelIDs) == 0 {
+			missing = "attendance.level_ids"
+		}
+	case "enrollment":
+		if c.EnrollmentListIDs.Departed == "" || c.EnrollmentListIDs.Enrolled == "" {
+			missing = "enrollment_list_ids.departed and enrollment_list_ids.enrolled"
+		}
+	}
+	if missing != "" {
+		return fmt.Errorf("%s needs %s in the config", job, missing)
+	}
+	return nil
+}
+
+/*
+Checks the config with the --profile and environment overrides applied: every field, every job's
+required fields, the commands schedules and pipelines run, the blackbaud auth file and that the DB
+can be reached. Every problem found is listed, not just the first.
+*/
+func ConfigValidate(cmd *cobra.Command, args []string) error {
+	out := cmd.OutOrStdout()
+	problems := []error{}
+	add := func(err error) {
+		if joined, ok := err.(interface{ Unwrap() []error }); ok {
+			problems = append(problems, joined.Unwrap()...)
+		} else if err != nil {
+			problems = append(problems, err)
+		}
+	}
+	config, err := loadConfig(fConfigFile)
+	var invalid configError
+	if err != nil && !errors.As(err, &invalid) {
+		return err
+	}
+	add(invalid.err)
+	for _, job := range slices.Sorted(maps.Keys(pipelineJobs())) {
+		add(config.require(job))
+	}
+	for _, job := range config.Schedules {
+		if err := runnable(job.Args); err != nil {
+			add(fmt.Errorf("schedule %s: %v", job.Name, err))
+		}
+	}
+	jobs := pipelineJobs()
+	for name, p := range config.Pipelines {
+		for _, s := range p.Stages {
+			if _, ok := jobs[s.Name]; !ok {
+				add(fmt.Errorf("pipelines.%s: stage %s is not a job", name, s.Name))
+			}
+		}
+	}
+	add(blackbaud.CheckConfig(fAuthFile))
+	db, err := database.Connect(config.Postgres)
+	if err == nil {
+		err = db.Conn.Ping(*db.Ctx)
+		db.Close()
+	}
+	if err != nil {
+		add(fmt.Errorf("postgres is not reachable: %v", err))
+	}
+	if len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Fprintln(out, "-", strings.ReplaceAll(secrets.Redact(p.Error()), "\n", "\n  "))
+		}
+		return fmt.Errorf("%s has %d problems", fConfigFile, len(problems))
+	}
+	fmt.Fprintf(out, "%s is valid\n", fConfigFile)
+	return nil
+}
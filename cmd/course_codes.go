@@ -0,0 +1,136 @@
+package cmd
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+
+	"github.com/BushSchoolIT/extractor/database"
+	"github.com/spf13/cobra"
+)
+
+var COURSE_CODE_HEADER = []string{"course_prefix", "transcript_category"}
+
+func CourseCodesImport(cmd *cobra.Command, args []string) error {
+	config, err := loadConfig(fConfigFile)
+	if err != nil {
+		slog.Error("Unable to load config", slog.Any("error", err))
+		return err
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		slog.Error("Unable to open course codes file", slog.Any("error", err))
+		return err
+	}
+	defer f.Close()
+	codes, err := readCourseCodes(f)
+	if err != nil {
+		slog.Error("Unable to read course codes file", slog.Any("error", err))
+		return err
+	}
+	db, err := connect(cmd, config)
+	if err != nil {
+		slog.Error("Unable to connect to DB", slog.Any("error", err))
+		return err
+	}
+	defer db.Close()
+	err = db.Lock(database.Locks{Exclusive: []string{"course_codes"}})
+	if err != nil {
+		slog.Error("Unable to lock course codes", slog.Any("error", err))
+		return err
+	}
+	err = db.ImportCourseCodes(codes, fReplaceCourseCodes)
+	if err != nil {
+		slog.Error("Unable to import course codes", slog.Any("error", err))
+		return err
+	}
+	slog.Info("Imported course codes", slog.Int("count", len(codes)), slog.Bool("replace", fReplaceCourseCodes))
+	return nil
+}
+
+func CourseCodesExport(cmd *cobra.Command, args []string) error {
+	config, err := loadConfig(fConfigFile)
+	if err != nil {
+		slog.Error("Unable to load config", slog.Any("error", err))
+		return err
+	}
+	db, err := connect(cmd, config)
+	if err != nil {
+		slog.Error("Unable to connect to DB", slog.Any("error", err))
+		return err
+	}
+	defer db.Close()
+	codes, err := db.CourseCodes()
+	if err != nil {
+		slog.Error("Unable to get course codes", slog.Any("error", err))
+		return err
+	}
+	out := cmd.OutOrStdout()
+	if len(args) == 1 {
+		f, err := os.Create(args[0])
+		if err != nil {
+			slog.Error("Unable to create course codes file", slog.Any("error", err))
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	w := csv.NewWriter(out)
+	w.Write(COURSE_CODE_HEADER)
+	for _, code := range codes {
+		w.Write([]string{code.Prefix, code.Category})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func CourseCodesUnmapped(cmd *cobra.Command, args []string) error {
+	config, err := loadConfig(fConfigFile)
+	if err != nil {
+		slog.Error("Unable to load config", slog.Any("error", err))
+		return err
+	}
+	db, err := connect(cmd, config)
+	if err != nil {
+		slog.Error("Unable to connect to DB", slog.Any("error", err))
+		return err
+	}
+	defer db.Close()
+	unmapped, err := db.UnmappedCourseCodes()
+	if err != nil {
+		slog.Error("Unable to get unmapped course codes", slog.Any("error", err))
+		return err
+	}
+	w := csv.NewWriter(cmd.OutOrStdout())
+	w.Write([]string{"course_code", "students", "nan_rows"})
+	for _, code := range unmapped {
+		w.Write([]string{code.CourseCode, strconv.Itoa(code.Students), strconv.Itoa(code.NaNRows)})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// reads course_prefix,transcript_category rows, the header row is optional
+func readCourseCodes(r io.Reader) ([]database.CourseCode, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = len(COURSE_CODE_HEADER)
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	codes := []database.CourseCode{}
+	for i, record := range records {
+		if i == 0 && record[0] == COURSE_CODE_HEADER[0] {
+			continue
+		}
+		if record[0] == "" || record[1] == "" {
+			return nil, fmt.Errorf("line %d: course prefix and transcript category are required", i+1)
+		}
+		codes = append(codes, database.CourseCode{Prefix: record[0], Category: record[1]})
+	}
+	return codes, nil
+}
@@ -4,13 +4,12 @@ import (
 	"log/slog"
 
 	"github.com/BushSchoolIT/extractor/blackbaud"
-	"github.com/BushSchoolIT/extractor/database"
 	"github.com/spf13/cobra"
 )
 
-func Enrollment(cmd *cobra.Command, args []string) error {
+func Enrollment(cmd *cobra.Command, args []string) (err error) {
 	// load config and blackbaud API
-	api, err := blackbaud.NewBBApiConnector(fAuthFile)
+	api, err := newAPI(cmd)
 	if err != nil {
 		slog.Error("Unable to access blackbaud api", slog.Any("error", err))
 		return err
@@ -20,30 +19,73 @@ func Enrollment(cmd *cobra.Command, args []string) error {
 		slog.Error("Unable to load config", slog.Any("error", err))
 		return err
 	}
-	db, err := database.Connect(config.Postgres)
+	db, err := connect(cmd, config)
 	if err != nil {
 		slog.Error("Unable to connect to DB", slog.Any("error", err))
 		return err
 	}
 	defer db.Close()
+	err = db.StartRun()
+	if err != nil {
+		slog.Error("Unable to record run", slog.Any("error", err))
+		return err
+	}
+	defer func() {
+		db.Summarize("lists", api.ListStats())
+		db.FinishRun(err)
+	}()
 	// actual logic
-	slog.Info("Processing enrolled List", slog.String("id", config.EnrollmentListIDs.Enrolled))
+	err = attachStores(api, &db)
+	if err != nil {
+		slog.Error("Unable to set up page storage", slog.Any("error", err))
+		return err
+	}
+	slog.Info("Processing enrolled List", slog.String("list_id", config.EnrollmentListIDs.Enrolled))
 
-	enrolled, err := blackbaud.ProcessList(api, config.EnrollmentListIDs.Enrolled)
+	params, err := incrementalParams(&db, config, cmd.Name())
+	if err != nil {
+		slog.Error("Unable to set up incremental extraction", slog.Any("error", err))
+		return err
+	}
+	enrolled, err := blackbaud.ProcessFilteredList(api, config.EnrollmentListIDs.Enrolled, params)
 	if err != nil {
 		slog.Error("Unable to get enrollment data", slog.Any("error", err))
 		return err
 	}
-	departed, err := blackbaud.ProcessList(api, config.EnrollmentListIDs.Departed)
+	departed, err := blackbaud.ProcessFilteredList(api, config.EnrollmentListIDs.Departed, params)
 	if err != nil {
 		slog.Error("Unable to get departed data", slog.Any("error", err))
 		return err
 	}
+	err = db.CheckListSchema(config.EnrollmentListIDs.Enrolled, enrolled.Columns)
+	if err == nil {
+		err = db.CheckListSchema(config.EnrollmentListIDs.Departed, departed.Columns)
+	}
+	if err != nil {
+		slog.Error("Enrollment list schema drifted", slog.Any("error", err))
+		return err
+	}
+	err = stage(&db)
+	if err != nil {
+		slog.Error("Unable to stage tables", slog.Any("error", err))
+		return err
+	}
+	defer db.Unstage()
 	err = db.EnrollmentOps(enrolled, departed)
 	if err != nil {
 		slog.Error("Unable to complete enrollment database operations", slog.Any("error", err))
 		return err
 	}
+	err = publish(&db, config, cmd.Name())
+	if err != nil {
+		return err
+	}
+	err = saveWatermark(&db, config, cmd.Name(), blackbaud.Merge(enrolled, departed))
+	if err != nil {
+		slog.Error("Unable to save watermark", slog.Any("error", err))
+		return err
+	}
+	clearCheckpoints(&db)
 	slog.Info("Import Complete")
 	return nil
 }
@@ -7,24 +7,50 @@ import (
 	"github.com/spf13/cobra"
 )
 
-func Gpa(cmd *cobra.Command, args []string) error {
+func Gpa(cmd *cobra.Command, args []string) (err error) {
 	config, err := loadConfig(fConfigFile)
 	if err != nil {
 		slog.Error("Unable to load config", slog.Any("error", err))
 		return err
 	}
-	db, err := database.Connect(config.Postgres)
+	db, err := connect(cmd, config)
 	if err != nil {
 		slog.Error("Unable to connect to DB", slog.Any("error", err))
 		return err
 	}
 	defer db.Close()
-	slog.Info("Doing GPA calculations")
-	err = db.GpaCalculation()
+	err = db.StartRun()
+	if err != nil {
+		slog.Error("Unable to record run", slog.Any("error", err))
+		return err
+	}
+	defer func() { db.FinishRun(err) }()
+	definitions := config.GpaDefinitions
+	if len(definitions) == 0 {
+		definitions = database.DEFAULT_GPA_DEFINITIONS
+	}
+	for _, d := range definitions {
+		if err := d.Validate(); err != nil {
+			slog.Error("Invalid GPA definition", slog.Any("error", err))
+			return err
+		}
+	}
+	err = stage(&db)
+	if err != nil {
+		slog.Error("Unable to stage tables", slog.Any("error", err))
+		return err
+	}
+	defer db.Unstage()
+	slog.Info("Doing GPA calculations", slog.Int("definitions", len(definitions)))
+	err = db.GpaCalculation(definitions)
 	if err != nil {
 		slog.Error("Unable to do GPA calculations", slog.Any("error", err))
 		return err
 	}
 	slog.Info("Finished GPA calculations")
+	err = publish(&db, config, cmd.Name())
+	if err != nil {
+		return err
+	}
 	return nil
 }
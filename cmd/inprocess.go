@@ -0,0 +1,134 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/BushSchoolIT/extractor/tracing"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// what started the run serve or worker is executing, recorded with it
+type runTrigger struct {
+	schedule string
+	attempt  int
+	reason   string
+	// the job_queue entry a worker claimed
+	queueJob int64
+}
+
+// set while serve or worker runs a command, nil otherwise
+var trigger *runTrigger
+
+// an error unless args name a command serve and worker can run in-process
+func runnable(args []string) error {
+	c, _, err := rootCmd.Find(args)
+	// by name since the commands themselves refer back to this
+	if err != nil || c.RunE == nil || c == rootCmd || (c.Parent() == rootCmd && slices.Contains([]string{"serve", "worker", "enqueue"}, c.Name())) {
+		return fmt.Errorf("%q is not a command that can be run in-process", strings.Join(args, " "))
+	}
+	return nil
+}
+
+// the values of the root's persistent flags, which runs started in-process start from
+func persistentFlagValues() map[string]string {
+	values := map[string]string{}
+	rootCmd.PersistentFlags().VisitAll(func(f *pflag.Flag) {
+		values[f.Name] = f.Value.String()
+	})
+	return values
+}
+
+/*
+Runs the command args name in-process, parsing its flags like the command line would on top of flags.
+The run gets a new run ID, which is returned, and logs tagged with it and attrs. The ID is "" when the
+run failed before it was started. Retries add --resume so lists continue from their checkpoints.
+*/
+func runInProcess(ctx context.Context, args []string, flags map[string]string, t runTrigger, attrs ...any) (id string, err error) {
+	if pipelinePool != nil {
+		// it resets the flags and run ID the running stages read
+		return "", fmt.Errorf("%q can't run in-process while a pipeline is running", strings.Join(args, " "))
+	}
+	if t.attempt > 1 {
+		args = append(slices.Clone(args), "--resume")
+	}
+	c, rest, err := rootCmd.Find(args)
+	if err != nil {
+		return "", err
+	}
+	err = resetFlags(flags)
+	if err != nil {
+		return "", err
+	}
+	err = c.ParseFlags(rest)
+	if err != nil {
+		return "", err
+	}
+	err = c.ValidateRequiredFlags()
+	if err != nil {
+		return "", err
+	}
+	err = c.ValidateArgs(c.Flags().Args())
+	if err != nil {
+		return "", err
+	}
+	id = newRunID()
+	runID = id
+	trigger = &t
+	defer func() { trigger = nil }()
+	tagLogs(c, attrs...)
+	slog.Info("Starting run", slog.String("reason", t.reason), slog.String("args", strings.Join(args, " ")))
+	ctx, span := tracing.Start(ctx, c.Name(), attribute.String("run_id", runID), attribute.String("reason", t.reason), attribute.Int("attempt", t.attempt))
+	defer func() { tracing.End(span, err) }()
+	c.SetContext(ctx)
+	start := time.Now()
+	err = c.RunE(c, c.Flags().Args())
+	if err != nil {
+		slog.Error("Run failed", slog.Duration("duration", time.Since(start)), slog.Any("error", err))
+		return id, err
+	}
+	slog.Info("Run finished", slog.Duration("duration", time.Since(start)))
+	return id, nil
+}
+
+/*
+Puts every flag back to the value serve or worker was started with, or its default, so runs don't inherit each
+other's flags. Every command's flags are reset, not just the one run, since run starts other commands.
+*/
+func resetFlags(serveFlags map[string]string) error {
+	var err error
+	reset := func(f *pflag.Flag) {
+		if err != nil {
+			return
+		}
+		value, ok := serveFlags[f.Name]
+		if !ok {
+			value = f.DefValue
+		}
+		if s, isSlice := f.Value.(pflag.SliceValue); isSlice {
+			items := []string{}
+			if value = strings.Trim(value, "[]"); value != "" {
+				items = strings.Split(value, ",")
+			}
+			err = s.Replace(items)
+		} else {
+			err = f.Value.Set(value)
+		}
+		f.Changed = false
+	}
+	var walk func(c *cobra.Command)
+	walk = func(c *cobra.Command) {
+		c.LocalFlags().VisitAll(reset)
+		for _, sub := range c.Commands() {
+			walk(sub)
+		}
+	}
+	walk(rootCmd)
+	return err
+}
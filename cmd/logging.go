@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/BushSchoolIT/extractor/logging"
+	"github.com/spf13/cobra"
+)
+
+var (
+	// the file logs go to with --log-file, closed once the command is done
+	logFile *logging.RotatingFile
+	// the handler before the run and command were attached, serve tags each run it starts with its own
+	logHandler slog.Handler
+)
+
+// sends slog records to stdout or --log-file in --log-format, tagging every one with the run and command
+func setupLogging(cmd *cobra.Command) error {
+	var w io.Writer = os.Stdout
+	if fLogFile != "" {
+		f, err := logging.OpenRotating(fLogFile, fLogRotate, fLogKeep)
+		if err != nil {
+			return err
+		}
+		logFile = f
+		w = f
+	}
+	handler, err := logging.NewHandler(w, fLogFormat, fLogLevel)
+	if err != nil {
+		return err
+	}
+	logHandler = handler
+	tagLogs(cmd)
+	return nil
+}
+
+func tagLogs(cmd *cobra.Command, attrs ...any) {
+	attrs = append([]any{slog.String("run_id", runID), slog.String("command", cmd.Name())}, attrs...)
+	slog.SetDefault(slog.New(logHandler).With(attrs...))
+}
+
+func closeLogging() {
+	if logFile != nil {
+		logFile.Close()
+	}
+}
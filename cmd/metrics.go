@@ -0,0 +1,32 @@
+package cmd
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/BushSchoolIT/extractor/metrics"
+)
+
+// the --metrics-addr server, stopped once the command is done
+var metricsServer *http.Server
+
+func startMetrics() {
+	if fMetricsAddr == "" {
+		return
+	}
+	metricsServer = metrics.Serve(fMetricsAddr)
+	metrics.SetReady(true)
+}
+
+// writes --metrics-textfile for node_exporter or a Pushgateway push and stops the metrics server
+func finishMetrics() {
+	if fMetricsTextfile != "" {
+		err := metrics.WriteTextfile(fMetricsTextfile)
+		if err != nil {
+			slog.Error("Unable to write metrics textfile", slog.String("path", fMetricsTextfile), slog.Any("error", err))
+		}
+	}
+	if metricsServer != nil {
+		metrics.Shutdown(metricsServer)
+	}
+}
@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/BushSchoolIT/extractor/database"
+	"github.com/BushSchoolIT/extractor/notify"
+	"github.com/BushSchoolIT/extractor/secrets"
+	"github.com/spf13/cobra"
+)
+
+// how long sending a run's notifications may take before it's given up on
+const NOTIFY_TIMEOUT = 30 * time.Second
+
+// the runs OnFinish notified about, keyed by run ID and job, so failures before them aren't notified twice
+var notifiedRuns sync.Map
+
+func runKey(runID string, job string) string {
+	return runID + "/" + job
+}
+
+/*
+Sends the run's result to the channels routed for its job and status once the run is recorded.
+Notifications are best effort, a channel that can't be reached is logged and doesn't fail the run.
+*/
+func notifyRuns(db *database.State, config notify.Config) error {
+	if fNoNotify || len(config.Routes) == 0 {
+		return nil
+	}
+	notifier, err := notify.New(config)
+	if err != nil {
+		return err
+	}
+	host, _ := os.Hostname()
+	db.OnFinish = func(r database.RunResult) {
+		notifiedRuns.Store(runKey(r.RunID, r.Job), true)
+		e := notify.Event{
+			Job:       r.Job,
+			RunID:     r.RunID,
+			Host:      host,
+			Status:    r.Status,
+			StartedAt: r.StartedAt,
+			Duration:  r.Duration,
+			RowsIn:    r.RowsIn,
+			Summary:   r.Summary,
+		}
+		if r.Error != nil {
+			e.Error = r.Error.Error()
+		}
+		send(notifier, e)
+	}
+	return nil
+}
+
+func send(notifier *notify.Notifier, e notify.Event) {
+	ctx, cancel := context.WithTimeout(context.Background(), NOTIFY_TIMEOUT)
+	defer cancel()
+	err := notifier.Notify(ctx, e)
+	if err != nil {
+		slog.Error("Unable to send notifications", slog.Any("error", err))
+	}
+}
+
+/*
+Wraps a job's RunE so it also notifies about failures from before its run was recorded, which are the
+ones OnFinish never sees: an expired blackbaud token, an invalid config or an unreachable DB.
+*/
+func notifyFailures(run func(*cobra.Command, []string) error) func(*cobra.Command, []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		start := time.Now()
+		err := run(cmd, args)
+		if err == nil || fNoNotify {
+			return err
+		}
+		if _, ok := notifiedRuns.Load(runKey(runID, cmd.Name())); ok {
+			return err
+		}
+		config, configErr := loadConfig(fConfigFile)
+		var invalid configError
+		if configErr != nil && !errors.As(configErr, &invalid) {
+			slog.Warn("Unable to load config to notify about the failure", slog.Any("error", configErr))
+			return err
+		}
+		if len(config.Notifications.Routes) == 0 {
+			return err
+		}
+		notifier, notifyErr := notify.New(config.Notifications)
+		if notifyErr != nil {
+			slog.Warn("Unable to notify about the failure", slog.Any("error", notifyErr))
+			return err
+		}
+		host, _ := os.Hostname()
+		send(notifier, notify.Event{
+			Job:       cmd.Name(),
+			RunID:     runID,
+			Host:      host,
+			Status:    notify.STATUS_FAILED,
+			StartedAt: start,
+			Duration:  time.Since(start),
+			Error:     secrets.Redact(err.Error()),
+		})
+		return err
+	}
+}
@@ -6,15 +6,14 @@ import (
 	"strings"
 
 	"github.com/BushSchoolIT/extractor/blackbaud"
-	"github.com/BushSchoolIT/extractor/database"
 	"github.com/spf13/cobra"
 )
 
 const YEAR_PREFIX string = "Grad Year"
 
-func Parents(cmd *cobra.Command, args []string) error {
+func Parents(cmd *cobra.Command, args []string) (err error) {
 	// load config and blackbaud API
-	api, err := blackbaud.NewBBApiConnector(fAuthFile)
+	api, err := newAPI(cmd)
 	if err != nil {
 		slog.Error("Unable to access blackbaud api", slog.Any("error", err))
 		return err
@@ -24,55 +23,81 @@ func Parents(cmd *cobra.Command, args []string) error {
 		slog.Error("Unable to load config", slog.Any("error", err))
 		return err
 	}
-	db, err := database.Connect(config.Postgres)
+	// grades are relative to the class graduating in the spring of the current year
+	_, endYear, err := academicYear(api)
+	if err != nil {
+		slog.Error("Invalid school year", slog.Any("error", err))
+		return err
+	}
+	db, err := connect(cmd, config)
 	if err != nil {
 		slog.Error("Unable to connect to DB", slog.Any("error", err))
 		return err
 	}
 	defer db.Close()
+	err = db.StartRun()
+	if err != nil {
+		slog.Error("Unable to record run", slog.Any("error", err))
+		return err
+	}
+	defer func() {
+		db.Summarize("lists", api.ListStats())
+		db.FinishRun(err)
+	}()
 
-	t := blackbaud.UnorderedTable{}
-	for page := 1; ; page++ {
-		parsed, err := api.GetAdvancedList(config.ParentsID, page)
-		if err != nil {
-			slog.Error("Unable to get advanced list", slog.String("id", config.ParentsID), slog.Int("page", page))
-			return err
-		}
-		if len(parsed.Results.Rows) == 0 {
-			break // No more data
-		}
-		if len(t.Columns) == 0 {
-			t.Columns = getParentColumns(parsed.Results.Rows[0])
-		}
-
-		slog.Info("Inserting data from page", slog.Int("page", page))
-		for _, row := range parsed.Results.Rows {
-			grades := []int{}
-			newRow := []any{}
-			for _, col := range row.Columns {
-				if strings.HasPrefix(col.Name, YEAR_PREFIX) {
-					s, ok := col.Value.(string)
-					if !ok {
-						continue
-					}
-					val, err := strconv.Atoi(s)
-					if err != nil {
-						continue
-					}
-					grades = append(grades, gradYearToGrade(val, api.StartYear))
+	err = attachStores(api, &db)
+	if err != nil {
+		slog.Error("Unable to set up page storage", slog.Any("error", err))
+		return err
+	}
+	list, err := blackbaud.ProcessList(api, config.ParentsID)
+	if err != nil {
+		slog.Error("Unable to get advanced list", slog.String("list_id", config.ParentsID), slog.Any("error", err))
+		return err
+	}
+	err = db.CheckListSchema(config.ParentsID, list.Columns)
+	if err != nil {
+		slog.Error("Parents list schema drifted", slog.Any("error", err))
+		return err
+	}
+	t := blackbaud.UnorderedTable{Columns: getParentColumns(list.Columns)}
+	for _, row := range list.Rows {
+		grades := []int{}
+		newRow := []any{}
+		for i, col := range list.Columns {
+			if strings.HasPrefix(col, YEAR_PREFIX) {
+				s, ok := row[i].(string)
+				if !ok {
+					continue
+				}
+				val, err := strconv.Atoi(s)
+				if err != nil {
 					continue
 				}
-				newRow = append(newRow, col.Value)
+				grades = append(grades, gradYearToGrade(val, endYear))
+				continue
 			}
-			newRow = append(newRow, grades)
-			t.Rows = append(t.Rows, newRow)
+			newRow = append(newRow, row[i])
 		}
+		newRow = append(newRow, grades)
+		t.Rows = append(t.Rows, newRow)
 	}
+	err = stage(&db)
+	if err != nil {
+		slog.Error("Unable to stage tables", slog.Any("error", err))
+		return err
+	}
+	defer db.Unstage()
 	err = db.InsertEmails(t)
 	if err != nil {
 		slog.Error("Unable to insert emails", slog.Any("error", err))
 		return err
 	}
+	err = publish(&db, config, cmd.Name())
+	if err != nil {
+		return err
+	}
+	clearCheckpoints(&db)
 	return nil
 }
 
@@ -80,13 +105,13 @@ func gradYearToGrade(graduationYear int, currentYear int) int {
 	return 12 - (graduationYear - currentYear)
 }
 
-func getParentColumns(row blackbaud.Row) []string {
+func getParentColumns(listColumns []string) []string {
 	columns := []string{}
-	for _, col := range row.Columns {
-		if strings.HasPrefix(col.Name, YEAR_PREFIX) {
+	for _, col := range listColumns {
+		if strings.HasPrefix(col, YEAR_PREFIX) {
 			continue
 		}
-		columns = append(columns, col.Name)
+		columns = append(columns, col)
 	}
 	// extra "grade" column because blackbaud doesn't support arrays in the list
 	columns = append(columns, "grade")
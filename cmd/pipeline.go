@@ -0,0 +1,142 @@
+package cmd
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/BushSchoolIT/extractor/blackbaud"
+	"github.com/BushSchoolIT/extractor/database"
+	"github.com/BushSchoolIT/extractor/runner"
+	"github.com/BushSchoolIT/extractor/secrets"
+	"github.com/BushSchoolIT/extractor/tracing"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/spf13/cobra"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// jobs run one after the other or side by side, e.g. transcripts and comments before gpa
+type Pipeline struct {
+	Stages []runner.Stage `json:"stages"`
+}
+
+/*
+Shared by the stages of the running pipeline, nil otherwise. Stages run their commands' RunE at the same
+time, so while a pipeline runs the package's globals, the flag variables, runID, trigger and replay, are
+only read. They are set before the stages start and nothing run as a stage assigns them, runInProcess
+refuses to run while a pipeline does since it's what sets them.
+*/
+var (
+	pipelineAPI  func() (*blackbaud.BBAPIConnector, error)
+	pipelinePool *pgxpool.Pool
+)
+
+// commands a pipeline stage can run, keyed by stage name
+func pipelineJobs() map[string]*cobra.Command {
+	return map[string]*cobra.Command{
+		transcriptCmd.Name(): transcriptCmd,
+		commentsCmd.Name():   commentsCmd,
+		parentsCmd.Name():    parentsCmd,
+		attendanceCmd.Name(): attendanceCmd,
+		enrollmentCmd.Name(): enrollmentCmd,
+		gpaCmd.Name():        gpaCmd,
+		validateCmd.Name():   validateCmd,
+	}
+}
+
+/*
+Runs the stages of a pipeline from the config, each once the stages it needs succeeded, with independent
+stages running at the same time. Stages share one API connector, and so its rate limiter, and a DB pool.
+Every stage is recorded in runs under the pipeline's run ID, the flags given to run apply to all of them.
+The pipeline itself is recorded too, as job run with its stages' statuses in the summary, and notified
+about like any job.
+*/
+func RunPipeline(cmd *cobra.Command, args []string) (err error) {
+	config, err := loadConfig(fConfigFile)
+	if err != nil {
+		slog.Error("Unable to load config", slog.Any("error", err))
+		return err
+	}
+	pipeline, ok := config.Pipelines[args[0]]
+	if !ok {
+		return fmt.Errorf("no pipeline %s in the config, pipelines: %s", args[0], strings.Join(slices.Sorted(maps.Keys(config.Pipelines)), ", "))
+	}
+	err = runner.CheckDAG(pipeline.Stages)
+	if err != nil {
+		return fmt.Errorf("pipeline %s: %v", args[0], err)
+	}
+	jobs := pipelineJobs()
+	for _, s := range pipeline.Stages {
+		if _, ok := jobs[s.Name]; !ok {
+			return fmt.Errorf("pipeline %s: stage %s is not a job, stages can be %s", args[0], s.Name, strings.Join(slices.Sorted(maps.Keys(jobs)), ", "))
+		}
+	}
+
+	// a connection for each stage and one for the pipeline's own run
+	pool, err := database.NewPool(config.Postgres, int32(len(pipeline.Stages)+1))
+	if err != nil {
+		slog.Error("Unable to connect to DB", slog.Any("error", err))
+		return err
+	}
+	defer pool.Close()
+	// the API is only connected to once a stage needs it, gpa and validate don't
+	pipelinePool, pipelineAPI = pool, sync.OnceValues(connectAPI)
+	defer func() { pipelinePool, pipelineAPI = nil, nil }()
+	db, err := connect(cmd, config)
+	if err != nil {
+		slog.Error("Unable to connect to DB", slog.Any("error", err))
+		return err
+	}
+	defer db.Close()
+	db.Summarize("pipeline", args[0])
+	err = db.StartRun()
+	if err != nil {
+		slog.Error("Unable to record run", slog.Any("error", err))
+		return err
+	}
+	stages := map[string]string{}
+	defer func() {
+		db.Summarize("stages", stages)
+		db.FinishRun(err)
+	}()
+
+	results := runner.RunDAG(pipeline.Stages, func(name string) (err error) {
+		job := jobs[name]
+		ctx, span := tracing.Start(commandContext(cmd), name, attribute.String("pipeline", args[0]))
+		defer func() { tracing.End(span, err) }()
+		job.SetContext(ctx)
+		slog.Info("Starting stage", slog.String("stage", name))
+		err = job.RunE(job, nil)
+		if err != nil {
+			slog.Error("Stage failed", slog.String("stage", name), slog.Any("error", err))
+			return err
+		}
+		slog.Info("Stage finished", slog.String("stage", name))
+		return nil
+	})
+
+	w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "STAGE\tSTATUS\tDURATION\tERROR")
+	failed := []string{}
+	for _, r := range results {
+		message := ""
+		if r.Err != nil {
+			message = secrets.Redact(r.Err.Error())
+		}
+		if r.Status != runner.STAGE_SUCCEEDED {
+			failed = append(failed, r.Name)
+		}
+		stages[r.Name] = r.Status
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.Name, r.Status, r.Duration.Round(time.Second), message)
+	}
+	w.Flush()
+	if len(failed) > 0 {
+		return fmt.Errorf("pipeline %s: stages %s did not succeed", args[0], strings.Join(failed, ", "))
+	}
+	return nil
+}
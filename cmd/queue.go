@@ -0,0 +1,185 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/BushSchoolIT/extractor/database"
+	"github.com/BushSchoolIT/extractor/metrics"
+	"github.com/spf13/cobra"
+)
+
+// consecutive failures to claim a job after which worker exits so its supervisor can restart it
+const WORKER_MAX_FAILURES int = 5
+
+// adds the command after -- to job_queue, e.g. enqueue -- transcripts --full-refresh
+func Enqueue(cmd *cobra.Command, args []string) error {
+	err := runnable(args)
+	if err != nil {
+		return err
+	}
+	if fEnqueueMaxAttempts < 1 {
+		return fmt.Errorf("--max-attempts must be at least 1")
+	}
+	config, err := loadConfig(fConfigFile)
+	if err != nil {
+		slog.Error("Unable to load config", slog.Any("error", err))
+		return err
+	}
+	db, err := database.Connect(config.Postgres)
+	if err != nil {
+		slog.Error("Unable to connect to DB", slog.Any("error", err))
+		return err
+	}
+	defer db.Close()
+	id, err := db.Enqueue(args, time.Now().Add(fEnqueueDelay), fEnqueueMaxAttempts)
+	if err != nil {
+		return err
+	}
+	slog.Info("Enqueued job", slog.Int64("job_id", id), slog.Any("args", args))
+	fmt.Fprintln(cmd.OutOrStdout(), id)
+	return nil
+}
+
+/*
+Claims jobs from job_queue and runs them in-process one at a time until interrupted, polling when the
+queue is empty. The lease on a running job is renewed every third of --lease, so when a worker dies its
+job is claimed again by another one once the lease runs out. Failed jobs are queued again with --resume
+until they run out of attempts. A broken connection to the DB is replaced, the worker exits with an error
+once WORKER_MAX_FAILURES claims in a row failed.
+*/
+func Worker(cmd *cobra.Command, args []string) error {
+	if fWorkerLease < 3*time.Second {
+		return fmt.Errorf("--lease must be at least 3s")
+	}
+	config, err := loadConfig(fConfigFile)
+	if err != nil {
+		slog.Error("Unable to load config", slog.Any("error", err))
+		return err
+	}
+	db, err := database.Connect(config.Postgres)
+	if err != nil {
+		slog.Error("Unable to connect to DB", slog.Any("error", err))
+		return err
+	}
+	defer db.Close()
+	worker := fWorkerID
+	if worker == "" {
+		host, _ := os.Hostname()
+		worker = fmt.Sprintf("%s:%d", host, os.Getpid())
+	}
+	ctx, stop := signal.NotifyContext(commandContext(cmd), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// the queue is still updated while a job finishes after an interrupt
+	queueCtx := context.WithoutCancel(ctx)
+	db.Ctx = &queueCtx
+	workerFlags := persistentFlagValues()
+	workerLogs := slog.Default()
+	metrics.SetReady(true)
+	defer metrics.SetReady(false)
+	slog.Info("Worker started", slog.String("worker", worker), slog.Duration("lease", fWorkerLease))
+	failures := 0
+	for ctx.Err() == nil {
+		job, err := db.ClaimJob(worker, fWorkerLease)
+		if err != nil {
+			failures++
+			slog.Error("Unable to claim job", slog.Int("failures", failures), slog.Any("error", err))
+			if failures >= WORKER_MAX_FAILURES {
+				return fmt.Errorf("unable to claim a job %d times in a row: %v", failures, err)
+			}
+			err = db.Reconnect(config.Postgres)
+			if err != nil {
+				slog.Error("Unable to reconnect to DB", slog.Any("error", err))
+			}
+		} else {
+			failures = 0
+		}
+		if job == nil {
+			select {
+			case <-ctx.Done():
+			case <-time.After(fWorkerPoll):
+			}
+			continue
+		}
+		jobRunID, runErr := runJob(queueCtx, &db, config.Postgres, *job, worker, workerFlags)
+		slog.SetDefault(workerLogs)
+		err = db.FinishJob(*job, worker, jobRunID, runErr)
+		if err != nil && db.Reconnect(config.Postgres) == nil {
+			// the connection may have broken while the job ran
+			err = db.FinishJob(*job, worker, jobRunID, runErr)
+		}
+		if err != nil {
+			slog.Error("Unable to finish job", slog.Int64("job_id", job.ID), slog.Any("error", err))
+		}
+	}
+	slog.Info("Worker stopped", slog.String("worker", worker))
+	return nil
+}
+
+// the job's context is cancelled with this once another worker may have claimed it
+var errLeaseLost = errors.New("lease on the job was lost")
+
+/*
+Runs a claimed job while a heartbeat renews its lease, the heartbeat has the queue connection to itself
+until the job returns. The job runs under a context cancelled once the lease is lost, either taken over
+by another worker or not renewed before it ran out, so the same job never runs twice at once.
+Returns the job's run ID, "" if it failed before a run was started.
+*/
+func runJob(ctx context.Context, db *database.State, dbConfig database.Config, job database.QueuedJob, worker string, flags map[string]string) (string, error) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(fWorkerLease / 3)
+		defer ticker.Stop()
+		renewed := time.Now()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				held, err := db.Heartbeat(job.ID, worker, fWorkerLease)
+				switch {
+				case err != nil && time.Since(renewed) >= fWorkerLease:
+					slog.Error("Unable to renew lease before it ran out, cancelling the job", slog.Int64("job_id", job.ID), slog.Any("error", err))
+					cancel(errLeaseLost)
+					return
+				case err != nil:
+					slog.Warn("Unable to renew lease", slog.Int64("job_id", job.ID), slog.Any("error", err))
+					err = db.Reconnect(dbConfig)
+					if err != nil {
+						slog.Warn("Unable to reconnect to DB", slog.Any("error", err))
+					}
+				case !held:
+					slog.Error("Lost the lease on the job, another worker took it over, cancelling it", slog.Int64("job_id", job.ID))
+					cancel(errLeaseLost)
+					return
+				default:
+					renewed = time.Now()
+				}
+			}
+		}
+	}()
+	defer wg.Wait()
+	defer close(done)
+	err := runnable(job.Args)
+	if err != nil {
+		return "", err
+	}
+	t := runTrigger{attempt: job.Attempts, reason: "queue", queueJob: job.ID}
+	id, err := runInProcess(ctx, job.Args, flags, t, slog.Int64("job_id", job.ID), slog.String("worker", worker), slog.Int("attempt", job.Attempts))
+	if context.Cause(ctx) == errLeaseLost {
+		return id, fmt.Errorf("%v: %v", errLeaseLost, err)
+	}
+	return id, err
+}
@@ -0,0 +1,35 @@
+package cmd
+
+import (
+	"fmt"
+	"log/slog"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func Rejects(cmd *cobra.Command, args []string) error {
+	config, err := loadConfig(fConfigFile)
+	if err != nil {
+		slog.Error("Unable to load config", slog.Any("error", err))
+		return err
+	}
+	db, err := connect(cmd, config)
+	if err != nil {
+		slog.Error("Unable to connect to DB", slog.Any("error", err))
+		return err
+	}
+	defer db.Close()
+	rejected, err := db.RejectedRows(fRejectsJob, fRejectsRun, fRejectsLimit)
+	if err != nil {
+		slog.Error("Unable to get rejected rows", slog.Any("error", err))
+		return err
+	}
+	w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tREJECTED AT\tJOB\tRUN\tREASON\tROW")
+	for _, r := range rejected {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", r.ID, r.RejectedAt.Format(time.DateTime), r.Job, r.RunID, r.Reason, string(r.Row))
+	}
+	return w.Flush()
+}
@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/spf13/cobra"
+)
+
+// commands whose lists are stored in raw_pages and can be reprocessed, keyed by job name
+func reprocessableJobs() map[string]*cobra.Command {
+	return map[string]*cobra.Command{
+		transcriptCmd.Name(): transcriptCmd,
+		commentsCmd.Name():   commentsCmd,
+		parentsCmd.Name():    parentsCmd,
+		enrollmentCmd.Name(): enrollmentCmd,
+	}
+}
+
+func Reprocess(cmd *cobra.Command, args []string) error {
+	config, err := loadConfig(fConfigFile)
+	if err != nil {
+		slog.Error("Unable to load config", slog.Any("error", err))
+		return err
+	}
+	db, err := connect(cmd, config)
+	if err != nil {
+		slog.Error("Unable to connect to DB", slog.Any("error", err))
+		return err
+	}
+	defer db.Close()
+	runs, err := db.StoredRuns(fReprocessRun)
+	if err != nil {
+		slog.Error("Unable to get stored run", slog.Any("error", err))
+		return err
+	}
+	if len(runs) == 0 {
+		return fmt.Errorf("run %s has no stored pages", fReprocessRun)
+	}
+	jobs := reprocessableJobs()
+	for _, run := range runs {
+		job, ok := jobs[run.Job]
+		if !ok {
+			return fmt.Errorf("job %s of run %s can't be reprocessed", run.Job, run.RunID)
+		}
+		slog.Info("Reprocessing run", slog.String("run", run.RunID), slog.String("job", run.Job))
+		replay = &run
+		replaySource = db.ReplaySource(run.RunID, run.Job)
+		job.SetContext(commandContext(cmd))
+		err = job.RunE(job, args)
+		replay, replaySource = nil, nil
+		if err != nil {
+			slog.Error("Unable to reprocess run", slog.String("run", run.RunID), slog.String("job", run.Job), slog.Any("error", err))
+			return err
+		}
+		slog.Info("Reprocessed run", slog.String("run", run.RunID), slog.String("job", run.Job))
+	}
+	return nil
+}
@@ -1,27 +1,49 @@
 package cmd
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/BushSchoolIT/extractor/blackbaud"
 	"github.com/BushSchoolIT/extractor/database"
+	"github.com/BushSchoolIT/extractor/logging"
+	"github.com/BushSchoolIT/extractor/notify"
+	"github.com/BushSchoolIT/extractor/scheduler"
+	"github.com/BushSchoolIT/extractor/secrets"
 	"github.com/spf13/cobra"
 	"io"
+	"log/slog"
 	"os"
+	"time"
 )
 
 var (
 	rootCmd = &cobra.Command{
 		Use:   "bbextract",
 		Short: "bbextract is the successor to BlackBaudExtractor rewritten in Go",
+		// errors are printed once by Execute, usage only for invalid arguments
+		SilenceErrors: true,
+		SilenceUsage:  true,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			runID = newRunID()
+			err := setupLogging(cmd)
+			if err != nil {
+				return err
+			}
+			startMetrics()
+			return startTracing(cmd)
+		},
 	}
 	transcriptCmd = &cobra.Command{
 		Use:   "transcripts",
 		Short: "Extracts transcript info from blackbaud and imports it into the database",
-		Run:   Transcripts,
+		RunE:  Transcripts,
 	}
 	gpaCmd = &cobra.Command{
 		Use:   "gpa",
-		Short: "Runs GPA ETL independently",
+		Short: "Runs GPA ETL independently, including the per-term GPA history",
 		RunE:  Gpa,
 	}
 	commentsCmd = &cobra.Command{
@@ -44,17 +66,161 @@ var (
 		Short: "Extracts enrollment info from blackbaud and imports into the database",
 		RunE:  Enrollment,
 	}
-	fLogFile    string
-	fLogLevel   string
-	fConfigFile string
-	fAuthFile   string
+	courseCodesCmd = &cobra.Command{
+		Use:   "course-codes",
+		Short: "Manages the course prefix to transcript category mappings",
+	}
+	courseCodesImportCmd = &cobra.Command{
+		Use:   "import <file.csv>",
+		Short: "Imports course_prefix,transcript_category mappings from a CSV file",
+		Args:  cobra.ExactArgs(1),
+		RunE:  CourseCodesImport,
+	}
+	courseCodesExportCmd = &cobra.Command{
+		Use:   "export [file.csv]",
+		Short: "Exports the course code mappings as CSV to a file or stdout",
+		Args:  cobra.MaximumNArgs(1),
+		RunE:  CourseCodesExport,
+	}
+	courseCodesUnmappedCmd = &cobra.Command{
+		Use:   "unmapped",
+		Short: "Lists transcript course codes that no course prefix matches, with student counts",
+		RunE:  CourseCodesUnmapped,
+	}
+	rejectsCmd = &cobra.Command{
+		Use:   "rejects",
+		Short: "Lists rows that were quarantined instead of loaded",
+		RunE:  Rejects,
+	}
+	reprocessCmd = &cobra.Command{
+		Use:   "reprocess",
+		Short: "Reruns the load and transforms of a run from its stored raw pages, without calling the API",
+		RunE:  Reprocess,
+	}
+	rollbackCmd = &cobra.Command{
+		Use:   "rollback",
+		Short: "Swaps a job's tables back with the generation replaced by its last staged load",
+		RunE:  Rollback,
+	}
+	runCmd = &cobra.Command{
+		Use:   "run <pipeline>",
+		Short: "Runs the jobs of a pipeline from the config in dependency order, independent ones at the same time",
+		Args:  cobra.ExactArgs(1),
+		RunE:  RunPipeline,
+	}
+	serveCmd = &cobra.Command{
+		Use:   "serve",
+		Short: "Runs the commands under schedules on their cron expressions until interrupted",
+		Args:  cobra.NoArgs,
+		RunE:  Serve,
+	}
+	enqueueCmd = &cobra.Command{
+		Use:   "enqueue [flags] -- <command> [args...]",
+		Short: "Queues a command for a worker to run, printing its job ID",
+		Args:  cobra.MinimumNArgs(1),
+		RunE:  Enqueue,
+	}
+	workerCmd = &cobra.Command{
+		Use:   "worker",
+		Short: "Runs queued commands, on as many hosts as needed, until interrupted",
+		Args:  cobra.NoArgs,
+		RunE:  Worker,
+	}
+	configCmd = &cobra.Command{
+		Use:   "config",
+		Short: "Inspects the config file",
+	}
+	configValidateCmd = &cobra.Command{
+		Use:   "validate",
+		Short: "Checks the config, with --profile and BBEXTRACT_* overrides applied, the auth file and that the DB is reachable",
+		Args:  cobra.NoArgs,
+		RunE:  ConfigValidate,
+	}
+	validateCmd = &cobra.Command{
+		Use:   "validate",
+		Short: "Checks the invariants configured under validations against the loaded tables",
+		RunE:  Validate,
+	}
+	fLogFile            string
+	fLogLevel           string
+	fLogFormat          string
+	fLogRotate          string
+	fLogKeep            int
+	fMetricsAddr        string
+	fMetricsTextfile    string
+	fTraceExporter      string
+	fTraceFile          string
+	fConfigFile         string
+	fAuthFile           string
+	fStrictCourseCodes  bool
+	fReplaceCourseCodes bool
+	fYears              int
+	fSchoolYear         string
+	fValidate           bool
+	fValidateJob        string
+	fValidateSamples    int
+	fRejectsRun         string
+	fRejectsJob         string
+	fRejectsLimit       int
+	fForce              bool
+	fSchemaDrift        string
+	fFullRefresh        bool
+	fResume             bool
+	fLists              []string
+	fConcurrency        int
+	fContinueOnError    bool
+	fWaitForLock        bool
+	fStaged             bool
+	fRollbackJob        string
+	fNoNotify           bool
+	fProfile            string
+	fEnqueueDelay       time.Duration
+	fEnqueueMaxAttempts int
+	fWorkerID           string
+	fWorkerLease        time.Duration
+	fWorkerPoll         time.Duration
+	// identifies this invocation in rejected_rows and the logs
+	runID string
+	// the stored run being replayed by reprocess, nil otherwise
+	replay        *database.StoredRun
+	replaySource  blackbaud.PageSource
+	fReprocessRun string
+)
+
+// exit codes shared by every command
+const (
+	EXIT_OK      int = 0
+	EXIT_FAILURE int = 1
+	// the job loaded what it could but some of its lists failed, see failed_lists in the run's summary
+	EXIT_PARTIAL int = 2
 )
 
+// returned by a job that committed the lists that succeeded while others failed (--continue-on-error)
+type partialError struct {
+	err error
+}
+
+func (e partialError) Error() string {
+	return fmt.Sprintf("partially loaded: %v", e.err)
+}
+
+func (e partialError) Unwrap() error {
+	return e.err
+}
+
 func Execute() {
-	if err := rootCmd.Execute(); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+	err := rootCmd.Execute()
+	finishTracing(err)
+	finishMetrics()
+	closeLogging()
+	if err == nil {
+		os.Exit(EXIT_OK)
+	}
+	fmt.Fprintln(os.Stderr, "Error:", secrets.Redact(err.Error()))
+	if errors.As(err, &partialError{}) {
+		os.Exit(EXIT_PARTIAL)
 	}
+	os.Exit(EXIT_FAILURE)
 }
 
 func init() {
@@ -64,7 +230,68 @@ func init() {
 	rootCmd.AddCommand(commentsCmd)
 	rootCmd.AddCommand(gpaCmd)
 	rootCmd.AddCommand(enrollmentCmd)
+	rootCmd.AddCommand(courseCodesCmd)
+	rootCmd.AddCommand(validateCmd)
+	rootCmd.AddCommand(rejectsCmd)
+	rootCmd.AddCommand(reprocessCmd)
+	rootCmd.AddCommand(rollbackCmd)
+	rootCmd.AddCommand(serveCmd)
+	rootCmd.AddCommand(runCmd)
+	rootCmd.AddCommand(enqueueCmd)
+	rootCmd.AddCommand(workerCmd)
+	rootCmd.AddCommand(configCmd)
+	for _, c := range []*cobra.Command{transcriptCmd, gpaCmd, commentsCmd, parentsCmd, attendanceCmd, enrollmentCmd, runCmd} {
+		c.RunE = notifyFailures(c.RunE)
+	}
+	configCmd.AddCommand(configValidateCmd)
+	courseCodesCmd.AddCommand(courseCodesImportCmd)
+	courseCodesCmd.AddCommand(courseCodesExportCmd)
+	courseCodesCmd.AddCommand(courseCodesUnmappedCmd)
+	transcriptCmd.Flags().BoolVar(&fStrictCourseCodes, "strict-course-codes", false, "fail instead of warning when course codes have no transcript category")
+	transcriptCmd.Flags().IntVar(&fConcurrency, "concurrency", 0, "lists fetched at once (defaults to concurrency in the config, or 4)")
+	transcriptCmd.Flags().BoolVar(&fContinueOnError, "continue-on-error", false, "load the lists that succeeded when others fail, exiting with status 2")
+	transcriptCmd.Flags().IntVar(&fYears, "years", 5, "number of academic years to clean up and rebuild")
+	rollbackCmd.Flags().StringVar(&fRollbackJob, "job", "", "job whose tables to roll back")
+	rollbackCmd.MarkFlagRequired("job")
+	enqueueCmd.Flags().DurationVar(&fEnqueueDelay, "delay", 0, "don't run the command before this much time has passed")
+	enqueueCmd.Flags().IntVar(&fEnqueueMaxAttempts, "max-attempts", 3, "times the command is tried before it's marked failed")
+	workerCmd.Flags().StringVar(&fWorkerID, "id", "", "name the worker claims jobs under (defaults to host:pid)")
+	workerCmd.Flags().DurationVar(&fWorkerLease, "lease", 5*time.Minute, "how long a job stays claimed without a heartbeat before another worker takes it over")
+	workerCmd.Flags().DurationVar(&fWorkerPoll, "poll", 10*time.Second, "how often an idle worker checks the queue")
+	reprocessCmd.Flags().StringVar(&fReprocessRun, "run", "", "ID of the run to reprocess")
+	reprocessCmd.MarkFlagRequired("run")
+	for _, c := range []*cobra.Command{transcriptCmd, parentsCmd, reprocessCmd} {
+		c.Flags().StringVar(&fSchoolYear, "school-year", "", `academic year to treat as current, e.g. "2024 - 2025" (defaults to the current blackbaud year)`)
+	}
+	courseCodesImportCmd.Flags().BoolVar(&fReplaceCourseCodes, "replace", false, "remove mappings that are not in the file")
 	rootCmd.PersistentFlags().StringVar(&fConfigFile, "config", "config.json", "config file containing list IDs")
+	rootCmd.PersistentFlags().StringVar(&fProfile, "profile", os.Getenv(ENV_PREFIX+"_PROFILE"), "profile from the config's profiles to merge over it, e.g. dev (defaults to $BBEXTRACT_PROFILE)")
+	rootCmd.PersistentFlags().BoolVar(&fValidate, "validate", false, "run the job's validations after it commits")
+	validateCmd.Flags().StringVar(&fValidateJob, "job", "", "only run validations for this job")
+	// the jobs run their validations with --validate or --staged
+	for _, c := range []*cobra.Command{validateCmd, transcriptCmd, gpaCmd, commentsCmd, parentsCmd, attendanceCmd, enrollmentCmd} {
+		c.Flags().IntVar(&fValidateSamples, "validate-samples", 5, "offending rows to show for each failed validation")
+	}
+	rejectsCmd.Flags().StringVar(&fRejectsRun, "run", "", "only show rows rejected by this run")
+	rejectsCmd.Flags().StringVar(&fRejectsJob, "job", "", "only show rows rejected by this job")
+	rejectsCmd.Flags().IntVar(&fRejectsLimit, "limit", 100, "maximum number of rows to show")
+	rootCmd.PersistentFlags().BoolVar(&fForce, "force", false, "load even if the incoming row count shrank more than max_shrink_percent")
+	rootCmd.PersistentFlags().StringVar(&fSchemaDrift, "schema-drift", database.SCHEMA_DRIFT_FAIL, "what to do when a list's columns changed since the last run: fail or warn (accepts the new columns)")
+	rootCmd.PersistentFlags().BoolVar(&fFullRefresh, "full-refresh", false, "pull entire lists even for jobs configured as incremental")
+	rootCmd.PersistentFlags().BoolVar(&fResume, "resume", false, "continue lists from the pages checkpointed by the last failed run")
+	rootCmd.PersistentFlags().StringSliceVar(&fLists, "lists", nil, "refetch only these list IDs, the others resume from their checkpoints")
+	rootCmd.PersistentFlags().BoolVar(&fStaged, "staged", false, "load into the staging schema, validate there and swap the tables into public at the end")
+	rootCmd.PersistentFlags().BoolVar(&fWaitForLock, "wait-for-lock", false, "wait for runs holding the job's table locks to finish instead of failing")
+	rootCmd.PersistentFlags().StringVar(&fLogFile, "log-file", "", "write logs to this file instead of stdout")
+	rootCmd.PersistentFlags().StringVar(&fLogLevel, "log-level", "info", "lowest level logged: debug, info, warn or error")
+	rootCmd.PersistentFlags().StringVar(&fLogFormat, "log-format", logging.FORMAT_TEXT, "log record format: text or json")
+	rootCmd.PersistentFlags().StringVar(&fLogRotate, "log-rotate", "", `rotate --log-file "daily" or once it reaches a size like 50MB`)
+	rootCmd.PersistentFlags().IntVar(&fLogKeep, "log-keep", 14, "rotated log files to keep, 0 keeps all of them")
+	rootCmd.PersistentFlags().StringVar(&fMetricsAddr, "metrics-addr", "", "serve /metrics, /healthz and /readyz on this address while running, e.g. :9464")
+	rootCmd.PersistentFlags().StringVar(&fMetricsTextfile, "metrics-textfile", "", "write the run's metrics to this file when the command finishes, e.g. for node_exporter's textfile collector")
+	rootCmd.PersistentFlags().StringVar(&fTraceExporter, "trace-exporter", "", "send OpenTelemetry spans to otlp (configured with the OTEL_EXPORTER_OTLP_* variables) or a JSON file")
+	rootCmd.PersistentFlags().StringVar(&fTraceFile, "trace-file", "traces.json", "file spans are appended to with --trace-exporter=file")
+	rootCmd.PersistentFlags().BoolVar(&fNoNotify, "no-notify", false, "don't send the notifications configured for the job")
 	rootCmd.PersistentFlags().StringVar(&fAuthFile, "auth", "bb_auth.json", "authconfig for blackbaud")
 }
 
@@ -80,14 +307,36 @@ type Config struct {
 		Departed string `json:"departed"`
 		Enrolled string `json:"enrolled"`
 	} `json:"enrollment_list_ids"`
+	GpaDefinitions []database.GpaDefinition `json:"gpa_definitions"`
+	Validations    []database.Validation    `json:"validations"`
+	// rows per run allowed to fail to insert, they are quarantined in rejected_rows instead
+	ErrorBudget int `json:"error_budget"`
+	// percentage the incoming rows may shrink by, compared to the table and the last successful run, 0 disables the check
+	MaxShrinkPercent float64 `json:"max_shrink_percent"`
+	// jobs that pull only the rows changed since their last run, keyed by command name
+	Incremental map[string]IncrementalConfig `json:"incremental"`
+	// how each job propagates rows deleted in blackbaud, keyed by command name
+	Sync map[string]database.SyncConfig `json:"sync"`
+	// lists fetched at once by jobs that read several
+	Concurrency int `json:"concurrency"`
+	// where messages about finished runs are sent
+	Notifications notify.Config `json:"notifications"`
+	// commands serve runs and when
+	Schedules []scheduler.Job `json:"schedules"`
+	// jobs run together by run, keyed by pipeline name
+	Pipelines map[string]Pipeline `json:"pipelines"`
+	// partial configs merged over this one with --profile, e.g. a dev database and lists
+	Profiles map[string]json.RawMessage `json:"profiles"`
 }
 
+// reads the config, merges --profile over it, applies BBEXTRACT_* overrides, resolves secrets and checks the result
 func loadConfig(configPath string) (Config, error) {
 	var config Config
 	f, err := os.Open(configPath)
 	if err != nil {
 		return config, err
 	}
+	defer f.Close()
 	data, err := io.ReadAll(f)
 	if err != nil {
 		return config, err
@@ -96,5 +345,180 @@ func loadConfig(configPath string) (Config, error) {
 	if err != nil {
 		return config, err
 	}
+	err = applyProfile(&config, fProfile)
+	if err != nil {
+		return config, err
+	}
+	err = applyEnv(&config)
+	if err != nil {
+		return config, err
+	}
+	err = config.Postgres.ResolveSecrets()
+	if err != nil {
+		return config, fmt.Errorf("postgres.password: %v", err)
+	}
+	err = config.Notifications.ResolveSecrets()
+	if err != nil {
+		return config, fmt.Errorf("notifications: %v", err)
+	}
+	err = config.Check()
+	if err != nil {
+		return config, configError{err}
+	}
 	return config, nil
 }
+
+// connects to the DB and tags it with the job and run so rejected rows can be traced back
+func connect(cmd *cobra.Command, config Config) (database.State, error) {
+	if fSchemaDrift != database.SCHEMA_DRIFT_FAIL && fSchemaDrift != database.SCHEMA_DRIFT_WARN {
+		return database.State{}, fmt.Errorf("--schema-drift must be %s or %s, got %q", database.SCHEMA_DRIFT_FAIL, database.SCHEMA_DRIFT_WARN, fSchemaDrift)
+	}
+	err := config.require(cmd.Name())
+	if err != nil {
+		return database.State{}, err
+	}
+	var db database.State
+	if pipelinePool != nil {
+		db, err = database.Acquire(pipelinePool)
+	} else {
+		db, err = database.Connect(config.Postgres)
+	}
+	if err != nil {
+		return db, err
+	}
+	ctx := commandContext(cmd)
+	db.Ctx = &ctx
+	db.Job = cmd.Name()
+	db.RunID = runID
+	db.ErrorBudget = config.ErrorBudget
+	db.MaxShrinkPercent = config.MaxShrinkPercent
+	db.Force = fForce
+	db.SchemaDrift = fSchemaDrift
+	db.LockWait = fWaitForLock
+	db.Sync = config.Sync[cmd.Name()]
+	err = db.Sync.Validate()
+	if err != nil {
+		db.Close()
+		return db, fmt.Errorf("sync of %s: %v", cmd.Name(), err)
+	}
+	err = notifyRuns(&db, config.Notifications)
+	if err != nil {
+		db.Close()
+		return db, fmt.Errorf("notifications: %v", err)
+	}
+	if replay != nil {
+		db.Summarize("reprocessed_from", replay.RunID)
+	}
+	if trigger != nil {
+		db.Schedule = trigger.schedule
+		db.Attempt = trigger.attempt
+		db.Summarize("trigger", trigger.reason)
+		if trigger.queueJob != 0 {
+			db.Summarize("queue_job", trigger.queueJob)
+		}
+	}
+	return db, nil
+}
+
+// the blackbaud API, or the pages of the run being reprocessed, with spans under the command's
+func newAPI(cmd *cobra.Command) (*blackbaud.BBAPIConnector, error) {
+	if pipelineAPI != nil {
+		api, err := pipelineAPI()
+		if err != nil {
+			return nil, err
+		}
+		api = api.Share()
+		api.SetContext(commandContext(cmd))
+		return api, nil
+	}
+	api, err := connectAPI()
+	if err != nil {
+		return nil, err
+	}
+	api.SetContext(commandContext(cmd))
+	return api, nil
+}
+
+func connectAPI() (*blackbaud.BBAPIConnector, error) {
+	if replay == nil {
+		return blackbaud.NewBBApiConnector(fAuthFile)
+	}
+	var start, end int
+	if year, ok := replay.Summary["school_year"].(string); ok {
+		fmt.Sscanf(year, "%d - %d", &start, &end)
+	}
+	if start == 0 && fSchoolYear == "" {
+		return nil, fmt.Errorf("run %s didn't record its school year, pass --school-year", replay.RunID)
+	}
+	return blackbaud.NewOfflineConnector(replaySource, start, end), nil
+}
+
+/*
+Stores the pages the job fetches: checkpoints so --resume can continue from them and --lists can refetch
+only some lists, and the raw JSON so the run can be reprocessed. Nothing is stored while replaying a run.
+*/
+func attachStores(api *blackbaud.BBAPIConnector, db *database.State) error {
+	if start, end, err := academicYear(api); err == nil {
+		db.Summarize("school_year", fmt.Sprintf("%d - %d", start, end))
+	}
+	if replay != nil {
+		return nil
+	}
+	api.RawPages = db.RawPages()
+	api.Checkpoints = db.Checkpoints()
+	api.Resume = fResume || len(fLists) > 0
+	for _, id := range fLists {
+		err := db.ClearListCheckpoints(id)
+		if err != nil {
+			return fmt.Errorf("unable to clear checkpoints of list %s: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// the job's load committed so its checkpoints are no longer needed
+func clearCheckpoints(db *database.State) {
+	err := db.ClearCheckpoints()
+	if err != nil {
+		slog.Warn("Unable to clear checkpoints", slog.Any("error", err))
+	}
+}
+
+const DEFAULT_CONCURRENCY int = 4
+
+// how many lists a job fetches at once, --concurrency wins over the config
+func concurrency(config Config) int {
+	if fConcurrency > 0 {
+		return fConcurrency
+	}
+	if config.Concurrency > 0 {
+		return config.Concurrency
+	}
+	return DEFAULT_CONCURRENCY
+}
+
+// sortable and unique enough across hosts, e.g. 20250718T115940-1a2b3c4d
+func newRunID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%s-%s", time.Now().UTC().Format("20060102T150405"), hex.EncodeToString(b))
+}
+
+/*
+The academic year a run treats as current, "2024 - 2025" gives 2024 and 2025.
+Comes from --school-year when set so older years can be rebuilt, otherwise from the blackbaud years API.
+*/
+func academicYear(api *blackbaud.BBAPIConnector) (int, int, error) {
+	if fSchoolYear == "" {
+		return api.StartYear, api.EndYear, nil
+	}
+	var startYear, endYear int
+	_, err := fmt.Sscanf(fSchoolYear, "%d - %d", &startYear, &endYear)
+	if err != nil {
+		return 0, 0, fmt.Errorf("school year %q is not formatted like \"2024 - 2025\": %v", fSchoolYear, err)
+	}
+	if endYear != startYear+1 {
+		return 0, 0, fmt.Errorf("school year %q must span two consecutive years", fSchoolYear)
+	}
+	return startYear, endYear, nil
+}
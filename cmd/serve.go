@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/BushSchoolIT/extractor/database"
+	"github.com/BushSchoolIT/extractor/metrics"
+	"github.com/BushSchoolIT/extractor/scheduler"
+	"github.com/spf13/cobra"
+)
+
+/*
+Runs the commands under schedules in-process until interrupted. Each run parses its args like the
+command line would, starting from the flags serve itself was given, and is recorded in runs along with
+its schedule and attempt. Retries add --resume so lists continue from their checkpoints.
+*/
+func Serve(cmd *cobra.Command, args []string) error {
+	config, err := loadConfig(fConfigFile)
+	if err != nil {
+		slog.Error("Unable to load config", slog.Any("error", err))
+		return err
+	}
+	for _, job := range config.Schedules {
+		err = runnable(job.Args)
+		if err != nil {
+			return fmt.Errorf("schedule %s: %v", job.Name, err)
+		}
+	}
+	serveFlags := persistentFlagValues()
+	serveLogs := slog.Default()
+
+	db, err := database.Connect(config.Postgres)
+	if err != nil {
+		slog.Error("Unable to connect to DB", slog.Any("error", err))
+		return err
+	}
+	defer db.Close()
+	ctx, stop := signal.NotifyContext(commandContext(cmd), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	db.Ctx = &ctx
+	lastRun := func(job scheduler.Job) (time.Time, bool, error) {
+		return db.LastScheduledRun(job.Name)
+	}
+	run := func(ctx context.Context, job scheduler.Job, attempt int, reason string) error {
+		defer slog.SetDefault(serveLogs)
+		t := runTrigger{schedule: job.Name, attempt: attempt, reason: reason}
+		_, err := runInProcess(ctx, job.Args, serveFlags, t, slog.String("schedule", job.Name), slog.Int("attempt", attempt))
+		return err
+	}
+	s, err := scheduler.New(config.Schedules, run, lastRun)
+	if err != nil {
+		return err
+	}
+	metrics.SetReady(true)
+	err = s.Run(ctx)
+	metrics.SetReady(false)
+	return err
+}
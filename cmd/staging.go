@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"log/slog"
+
+	"github.com/BushSchoolIT/extractor/database"
+	"github.com/spf13/cobra"
+)
+
+// with --staged the job loads into copies of its tables in the staging schema, see publish
+func stage(db *database.State) error {
+	if !fStaged {
+		return nil
+	}
+	db.Summarize("staged", true)
+	return db.Stage()
+}
+
+/*
+Runs the job's validations when asked and, for staged loads, swaps the staged tables into public.
+Staged loads are always validated and a failed validation leaves public as it was.
+*/
+func publish(db *database.State, config Config, job string) error {
+	if fValidate || db.Staged {
+		err := runValidations(db, config, job)
+		if err != nil {
+			return err
+		}
+	}
+	err := db.SwapStaged()
+	if err != nil {
+		slog.Error("Unable to publish staged tables", slog.Any("error", err))
+		return err
+	}
+	return nil
+}
+
+func Rollback(cmd *cobra.Command, args []string) error {
+	config, err := loadConfig(fConfigFile)
+	if err != nil {
+		slog.Error("Unable to load config", slog.Any("error", err))
+		return err
+	}
+	db, err := connect(cmd, config)
+	if err != nil {
+		slog.Error("Unable to connect to DB", slog.Any("error", err))
+		return err
+	}
+	defer db.Close()
+	// the job's own locks, so a running load can't swap at the same time
+	db.Job = fRollbackJob
+	err = db.LockJob()
+	if err != nil {
+		slog.Error("Unable to lock tables", slog.Any("error", err))
+		return err
+	}
+	err = db.RollbackSwap()
+	if err != nil {
+		slog.Error("Unable to roll back", slog.String("job", fRollbackJob), slog.Any("error", err))
+		return err
+	}
+	slog.Info("Rolled back to the previous generation", slog.String("job", fRollbackJob), slog.Any("tables", database.JOB_LOCKS[fRollbackJob].Exclusive))
+	return nil
+}
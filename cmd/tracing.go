@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/BushSchoolIT/extractor/tracing"
+	"github.com/spf13/cobra"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	// the span covering the whole command, every other span descends from it
+	commandSpan     trace.Span
+	shutdownTracing func(context.Context) error
+)
+
+// installs the --trace-exporter and starts the command's span, which becomes the command's context
+func startTracing(cmd *cobra.Command) error {
+	shutdown, err := tracing.Setup(fTraceExporter, fTraceFile)
+	if err != nil {
+		return err
+	}
+	shutdownTracing = shutdown
+	ctx, span := tracing.Start(commandContext(cmd), cmd.Name(), attribute.String("run_id", runID))
+	commandSpan = span
+	cmd.SetContext(ctx)
+	return nil
+}
+
+// ends the command's span with its result and flushes the exporter
+func finishTracing(err error) {
+	if commandSpan != nil {
+		tracing.End(commandSpan, err)
+	}
+	if shutdownTracing == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := shutdownTracing(ctx); err != nil {
+		slog.Error("Unable to flush traces", slog.Any("error", err))
+	}
+}
+
+// the command's context, commands run in-process by another one may not have one
+func commandContext(cmd *cobra.Command) context.Context {
+	if ctx := cmd.Context(); ctx != nil {
+		return ctx
+	}
+	return context.Background()
+}
@@ -3,105 +3,199 @@ package cmd
 import (
 	"fmt"
 	"log/slog"
-	"os"
-	"sync"
+	"net/url"
+	"slices"
 
 	"github.com/BushSchoolIT/extractor/blackbaud"
 	"github.com/BushSchoolIT/extractor/database"
+	"github.com/BushSchoolIT/extractor/runner"
 	"github.com/spf13/cobra"
 )
 
-func Transcripts(cmd *cobra.Command, args []string) {
+func Transcripts(cmd *cobra.Command, args []string) (err error) {
 	// load config and blackbaud API
-	api, err := blackbaud.NewBBApiConnector(fAuthFile)
+	api, err := newAPI(cmd)
 	if err != nil {
 		slog.Error("Unable to access blackbaud api", slog.Any("error", err))
-		os.Exit(1)
+		return err
 	}
 	config, err := loadConfig(fConfigFile)
 	if err != nil {
 		slog.Error("Unable to load config", slog.Any("error", err))
-		os.Exit(1)
+		return err
 	}
-	db, err := database.Connect(config.Postgres)
+	startYear, endYear, err := academicYear(api)
+	if err != nil {
+		slog.Error("Invalid school year", slog.Any("error", err))
+		return err
+	}
+	if fYears < 1 {
+		slog.Error("Invalid backfill window", slog.Int("years", fYears))
+		return fmt.Errorf("--years must be at least 1, got %d", fYears)
+	}
+	for _, id := range fLists {
+		if !slices.Contains(config.TranscriptListIDs, id) {
+			slog.Error("List is not a transcript list", slog.String("list_id", id))
+			return fmt.Errorf("list %s is not a transcript list", id)
+		}
+	}
+	db, err := connect(cmd, config)
 	if err != nil {
 		slog.Error("Unable to connect to DB", slog.Any("error", err))
-		os.Exit(1)
+		return err
 	}
 	defer db.Close()
-	// actual logic
-
-	var (
-		t     blackbaud.UnorderedTable
-		tLock sync.Mutex
-		wg    sync.WaitGroup
-		errCh = make(chan error, len(config.TranscriptListIDs))
-	)
-	for _, id := range config.TranscriptListIDs {
-		wg.Add(1)
-		go func(id string) {
-			defer wg.Done()
-			slog.Info("Processing List", slog.String("id", id))
-			localTable, err := processTranscriptList(api, id)
+	err = db.StartRun()
+	if err != nil {
+		slog.Error("Unable to record run", slog.Any("error", err))
+		return err
+	}
+	defer func() {
+		db.Summarize("lists", api.ListStats())
+		db.FinishRun(err)
+	}()
 
-			if err != nil {
-				errCh <- fmt.Errorf("id: %s, error: %v", id, err)
-			}
+	err = attachStores(api, &db)
+	if err != nil {
+		slog.Error("Unable to set up page storage", slog.Any("error", err))
+		return err
+	}
+	params, err := incrementalParams(&db, config, cmd.Name())
+	if err != nil {
+		slog.Error("Unable to set up incremental extraction", slog.Any("error", err))
+		return err
+	}
 
-			tLock.Lock()
-			defer tLock.Unlock()
-			// Set columns only once
-			if len(t.Columns) == 0 && len(localTable.Columns) > 0 {
-				t.Columns = localTable.Columns
-			}
-			t.Rows = append(t.Rows, localTable.Rows...)
-			slog.Info("Processed List", slog.String("id", id))
-		}(id)
+	// actual logic
+	results := runner.Run(config.TranscriptListIDs, concurrency(config), func(id string) (blackbaud.UnorderedTable, error) {
+		slog.Info("Processing List", slog.String("list_id", id))
+		t, err := processTranscriptList(api, id, params)
+		if err != nil {
+			return t, err
+		}
+		slog.Info("Processed List", slog.String("list_id", id))
+		return t, nil
+	})
+	succeeded, failed := runner.Partition(results)
+	listErr := runner.Errors(results)
+	if listErr != nil {
+		slog.Error("Unable to fetch transcript info", slog.Any("error", listErr))
+		db.Summarize("failed_lists", failedIDs(failed))
+		if !fContinueOnError || len(succeeded) == 0 {
+			return listErr
+		}
+		slog.Warn("Loading the lists that succeeded", slog.Int("succeeded", len(succeeded)), slog.Int("failed", len(failed)))
+		if db.Sync.Mode != "" {
+			// the failed lists' rows would look deleted
+			slog.Warn("Skipping deletion sync because lists failed")
+			db.Sync.Mode = ""
+		}
+	}
+	// merge in config order, realigning every list onto the first one's columns by name
+	ordered := []blackbaud.UnorderedTable{}
+	for _, r := range succeeded {
+		err = db.CheckListSchema(r.ID, r.Value.Columns)
+		if err != nil {
+			slog.Error("Transcript list schema drifted", slog.Any("error", err))
+			return err
+		}
+		ordered = append(ordered, r.Value)
 	}
-	wg.Wait()
-	close(errCh)
-	for e := range errCh {
-		slog.Error("Unable to fetch transcript info", slog.Any("error", e))
-		os.Exit(1)
+	t := blackbaud.Merge(ordered...)
+	years := fYears
+	if db.Incremental {
+		// only the years that were pulled can be cleaned up, older derived rows wouldn't be reinserted
+		years = yearsCovered(t, endYear)
 	}
 
 	slog.Info("Import Complete")
-	slog.Info("Starting Transcripts Database transformations")
-	err = db.TranscriptOps(t, api.StartYear, api.EndYear)
+	err = stage(&db)
+	if err != nil {
+		slog.Error("Unable to stage tables", slog.Any("error", err))
+		return err
+	}
+	defer db.Unstage()
+	slog.Info("Starting Transcripts Database transformations", slog.String("school_year", fmt.Sprintf("%d - %d", startYear, endYear)), slog.Int("years", years))
+	err = db.TranscriptOps(t, database.TranscriptOptions{
+		StartYear:         startYear,
+		EndYear:           endYear,
+		Years:             years,
+		StrictCourseCodes: fStrictCourseCodes,
+		PartialLists:      listErr != nil,
+	})
 	if err != nil {
 		slog.Error("Unable to complete transcript operations", slog.Any("error", err))
-		os.Exit(1)
+		return err
 	}
 	slog.Info("Finished Transcripts Database transformations")
+	err = publish(&db, config, cmd.Name())
+	if err != nil {
+		return err
+	}
+	if listErr != nil {
+		// the failed lists keep their checkpoints and the watermark stays put so the next run picks them up
+		for _, r := range succeeded {
+			err = db.ClearListCheckpoints(r.ID)
+			if err != nil {
+				slog.Warn("Unable to clear checkpoints", slog.String("list_id", r.ID), slog.Any("error", err))
+			}
+		}
+		return partialError{listErr}
+	}
+	err = saveWatermark(&db, config, cmd.Name(), t)
+	if err != nil {
+		slog.Error("Unable to save watermark", slog.Any("error", err))
+		return err
+	}
+	clearCheckpoints(&db)
 	slog.Info("Finished All Database transformations")
+	return nil
 }
 
-func processTranscriptList(api *blackbaud.BBAPIConnector, id string) (blackbaud.UnorderedTable, error) {
-	t := blackbaud.UnorderedTable{}
-	for page := 1; ; page++ {
-		parsed, err := api.GetAdvancedList(id, page)
-		if err != nil {
-			slog.Error("Unable to get advanced list", slog.String("id", id), slog.Int("page", page))
-			return t, fmt.Errorf("Unable to get advanced list, id: %s, err: %v", id, err)
-		}
-		if len(parsed.Results.Rows) == 0 {
-			break // No more data
-		}
-		if len(t.Columns) == 0 {
-			t.Columns = blackbaud.GetColumns(parsed.Results.Rows[0])
-		}
+// IDs of the lists that failed, recorded in the run summary
+func failedIDs[T any](failed []runner.Result[T]) []string {
+	ids := []string{}
+	for _, r := range failed {
+		ids = append(ids, r.ID)
+	}
+	return ids
+}
 
-		slog.Info("Collecting Data From Page", slog.Int("page", page), slog.String("id", id))
-		for _, row := range parsed.Results.Rows {
-			newRow := []any{}
-			for _, col := range row.Columns {
-				if col.Name == "grade_id" && col.Value == nil {
-					col.Value = 999999
-				}
-				newRow = append(newRow, col.Value)
-			}
-			t.Rows = append(t.Rows, newRow)
+func processTranscriptList(api *blackbaud.BBAPIConnector, id string, params url.Values) (blackbaud.UnorderedTable, error) {
+	t, err := blackbaud.ProcessFilteredList(api, id, params)
+	if err != nil {
+		return t, err
+	}
+	gradeID := slices.Index(t.Columns, "grade_id")
+	if gradeID == -1 {
+		return t, nil
+	}
+	// scheduled courses don't have a grade yet, they get a placeholder grade_id so they still have a primary key
+	for _, row := range t.Rows {
+		if row[gradeID] == nil {
+			row[gradeID] = 999999
 		}
 	}
 	return t, nil
 }
+
+// number of academic years, counting back from endYear, that have rows in t
+func yearsCovered(t blackbaud.UnorderedTable, endYear int) int {
+	i := slices.Index(t.Columns, "school_year")
+	if i == -1 {
+		return 0
+	}
+	years := 0
+	for _, row := range t.Rows {
+		var start, end int
+		s, ok := row[i].(string)
+		if !ok {
+			continue
+		}
+		if _, err := fmt.Sscanf(s, "%d - %d", &start, &end); err != nil {
+			continue
+		}
+		years = max(years, endYear-end+1)
+	}
+	return years
+}
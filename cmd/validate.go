@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/BushSchoolIT/extractor/database"
+	"github.com/spf13/cobra"
+)
+
+func Validate(cmd *cobra.Command, args []string) error {
+	config, err := loadConfig(fConfigFile)
+	if err != nil {
+		slog.Error("Unable to load config", slog.Any("error", err))
+		return err
+	}
+	db, err := connect(cmd, config)
+	if err != nil {
+		slog.Error("Unable to connect to DB", slog.Any("error", err))
+		return err
+	}
+	defer db.Close()
+	return runValidations(&db, config, fValidateJob)
+}
+
+// runs the configured validations for a job ("" for all of them), failing if any invariant is broken
+func runValidations(db *database.State, config Config, job string) error {
+	validations := []database.Validation{}
+	for _, v := range config.Validations {
+		if job == "" || v.AppliesTo(job) {
+			validations = append(validations, v)
+		}
+	}
+	slog.Info("Running validations", slog.Int("count", len(validations)), slog.String("job", job))
+	results, err := db.Validate(validations, fValidateSamples)
+	if err != nil {
+		slog.Error("Unable to run validations", slog.Any("error", err))
+		return err
+	}
+	failed := []string{}
+	for _, result := range results {
+		if result.Passed() {
+			slog.Info("Validation passed", slog.String("name", result.Validation.Name))
+			continue
+		}
+		failed = append(failed, result.Validation.Name)
+		slog.Error("Validation failed",
+			slog.String("name", result.Validation.Name),
+			slog.String("description", result.Validation.Description),
+			slog.Int("rows", result.Failures),
+		)
+		for _, sample := range result.Samples {
+			pairs := []string{}
+			for i, value := range sample {
+				pairs = append(pairs, fmt.Sprintf("%s=%s", result.Columns[i], value))
+			}
+			slog.Error("Offending row", slog.String("name", result.Validation.Name), slog.String("row", strings.Join(pairs, " ")))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d validations failed: %s", len(failed), strings.Join(failed, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+
+	"github.com/BushSchoolIT/extractor/blackbaud"
+)
+
+/*
+Stores the pages of the lists a job fetches in public.list_checkpoints so a failed run can be resumed
+with --resume. Lists are fetched concurrently while the State has a single connection, hence connLock.
+*/
+type checkpointStore struct {
+	db *State
+}
+
+// a blackbaud.PageStore that checkpoints pages under the State's job
+func (db *State) Checkpoints() blackbaud.PageStore {
+	return &checkpointStore{db: db}
+}
+
+func (c *checkpointStore) LoadPages(id string, params url.Values) ([]blackbaud.AdvancedList, bool, error) {
+	c.db.connLock.Lock()
+	defer c.db.connLock.Unlock()
+	db := c.db
+	complete := false
+	err := db.Conn.QueryRow(*db.Ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM list_progress
+			WHERE job = $1 AND list_id = $2 AND params = $3 AND complete
+		)`, db.Job, id, params.Encode()).Scan(&complete)
+	if err != nil {
+		return nil, false, err
+	}
+	rows, err := db.Conn.Query(*db.Ctx, `
+		SELECT page, data
+		FROM list_checkpoints
+		WHERE job = $1 AND list_id = $2 AND params = $3
+		ORDER BY page`, db.Job, id, params.Encode())
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+	pages := []blackbaud.AdvancedList{}
+	for rows.Next() {
+		var (
+			page int
+			data []byte
+		)
+		err := rows.Scan(&page, &data)
+		if err != nil {
+			return nil, false, err
+		}
+		// only a contiguous run of pages from the first one can be resumed
+		if page != len(pages)+1 {
+			complete = false
+			break
+		}
+		parsed := blackbaud.AdvancedList{}
+		err = json.Unmarshal(data, &parsed)
+		if err != nil {
+			return nil, false, fmt.Errorf("page %d is corrupt: %v", page, err)
+		}
+		pages = append(pages, parsed)
+	}
+	return pages, complete, rows.Err()
+}
+
+func (c *checkpointStore) SavePage(id string, params url.Values, page int, list blackbaud.AdvancedList) error {
+	c.db.connLock.Lock()
+	defer c.db.connLock.Unlock()
+	db := c.db
+	data, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	_, err = db.Conn.Exec(*db.Ctx, `
+	INSERT INTO list_checkpoints (job, list_id, params, page, run_id, data, fetched_at)
+	VALUES ($1, $2, $3, $4, $5, $6, now())
+	ON CONFLICT (job, list_id, params, page)
+	DO UPDATE SET run_id = EXCLUDED.run_id, data = EXCLUDED.data, fetched_at = EXCLUDED.fetched_at;`,
+		db.Job, id, params.Encode(), page, db.RunID, string(data))
+	if err != nil {
+		return err
+	}
+	_, err = db.Conn.Exec(*db.Ctx, `
+	INSERT INTO list_progress (job, list_id, params, pages, complete, updated_at)
+	VALUES ($1, $2, $3, $4, false, now())
+	ON CONFLICT (job, list_id, params)
+	DO UPDATE SET pages = EXCLUDED.pages, complete = false, updated_at = EXCLUDED.updated_at;`,
+		db.Job, id, params.Encode(), page)
+	return err
+}
+
+func (c *checkpointStore) CompleteList(id string, params url.Values) error {
+	c.db.connLock.Lock()
+	defer c.db.connLock.Unlock()
+	db := c.db
+	_, err := db.Conn.Exec(*db.Ctx, `
+	INSERT INTO list_progress (job, list_id, params, pages, complete, updated_at)
+	VALUES ($1, $2, $3, 0, true, now())
+	ON CONFLICT (job, list_id, params)
+	DO UPDATE SET complete = true, updated_at = EXCLUDED.updated_at;`,
+		db.Job, id, params.Encode())
+	return err
+}
+
+func (c *checkpointStore) ClearList(id string, params url.Values) error {
+	c.db.connLock.Lock()
+	defer c.db.connLock.Unlock()
+	db := c.db
+	_, err := db.Conn.Exec(*db.Ctx, `DELETE FROM list_checkpoints WHERE job = $1 AND list_id = $2 AND params = $3`, db.Job, id, params.Encode())
+	if err != nil {
+		return err
+	}
+	_, err = db.Conn.Exec(*db.Ctx, `DELETE FROM list_progress WHERE job = $1 AND list_id = $2 AND params = $3`, db.Job, id, params.Encode())
+	return err
+}
+
+// drops a list's checkpoints whatever parameters it was read with, used to force a refetch
+func (db *State) ClearListCheckpoints(id string) error {
+	_, err := db.Conn.Exec(*db.Ctx, `DELETE FROM list_checkpoints WHERE job = $1 AND list_id = $2`, db.Job, id)
+	if err != nil {
+		return err
+	}
+	_, err = db.Conn.Exec(*db.Ctx, `DELETE FROM list_progress WHERE job = $1 AND list_id = $2`, db.Job, id)
+	return err
+}
+
+// drops every checkpoint of the job, done once its load committed since there's nothing left to resume
+func (db *State) ClearCheckpoints() error {
+	_, err := db.Conn.Exec(*db.Ctx, `DELETE FROM list_checkpoints WHERE job = $1`, db.Job)
+	if err != nil {
+		return err
+	}
+	_, err = db.Conn.Exec(*db.Ctx, `DELETE FROM list_progress WHERE job = $1`, db.Job)
+	return err
+}
@@ -0,0 +1,109 @@
+package database
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// a row of public.course_codes, every course code starting with Prefix belongs to Category
+type CourseCode struct {
+	Prefix   string
+	Category string
+}
+
+// a transcript course code that no course_codes prefix matches
+type UnmappedCourseCode struct {
+	CourseCode string
+	Students   int
+	// rows still using the 'NaN' placeholder, these are the ones missing from reports
+	NaNRows int
+}
+
+// used for anything that can run a query, a pgx.Conn or a pgx.Tx
+type querier interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+func (db *State) CourseCodes() ([]CourseCode, error) {
+	rows, err := db.Conn.Query(*db.Ctx, `
+		SELECT course_prefix, transcript_category
+		FROM course_codes
+		ORDER BY course_prefix`)
+	if err != nil {
+		return nil, err
+	}
+	codes := []CourseCode{}
+	for rows.Next() {
+		code := CourseCode{}
+		err := rows.Scan(&code.Prefix, &code.Category)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, rows.Err()
+}
+
+// upserts the course code mappings, replace removes every mapping not in codes
+func (db *State) ImportCourseCodes(codes []CourseCode, replace bool) error {
+	tx, err := db.Conn.BeginTx(*db.Ctx, pgx.TxOptions{})
+	if err != nil {
+		return err
+	}
+	if replace {
+		cmd, err := tx.Exec(*db.Ctx, `DELETE FROM course_codes;`)
+		if err != nil {
+			tx.Rollback(*db.Ctx)
+			return fmt.Errorf("failed to clear course codes: %v, cmd: %s", err, cmd.String())
+		}
+	}
+	for _, code := range codes {
+		cmd, err := tx.Exec(*db.Ctx, `
+		INSERT INTO course_codes (course_prefix, transcript_category) VALUES ($1, $2)
+		ON CONFLICT (course_prefix)
+		DO UPDATE SET transcript_category = EXCLUDED.transcript_category;`,
+			code.Prefix, code.Category)
+		if err != nil {
+			tx.Rollback(*db.Ctx)
+			return fmt.Errorf("failed to import course code %s: %v, cmd: %s", code.Prefix, err, cmd.String())
+		}
+	}
+	return tx.Commit(*db.Ctx)
+}
+
+func (db *State) UnmappedCourseCodes() ([]UnmappedCourseCode, error) {
+	return unmappedCourseCodes(db.Ctx, db.Conn)
+}
+
+func unmappedCourseCodes(ctx *context.Context, q querier) ([]UnmappedCourseCode, error) {
+	rows, err := q.Query(*ctx, `
+		SELECT
+			transcripts.course_code::text,
+			COUNT(DISTINCT transcripts.student_user_id),
+			COUNT(*) FILTER (WHERE transcripts.transcript_category = 'NaN')
+		FROM transcripts
+		WHERE transcripts.course_code IS NOT NULL
+			AND NOT EXISTS (
+				SELECT 1 FROM course_codes
+				WHERE transcripts.course_code::text LIKE course_codes.course_prefix || '%'
+			)
+		GROUP BY transcripts.course_code
+		ORDER BY COUNT(DISTINCT transcripts.student_user_id) DESC, transcripts.course_code`)
+	if err != nil {
+		return nil, err
+	}
+	codes := []UnmappedCourseCode{}
+	for rows.Next() {
+		code := UnmappedCourseCode{}
+		err := rows.Scan(&code.CourseCode, &code.Students, &code.NaNRows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, rows.Err()
+}
@@ -3,37 +3,187 @@ package database
 import (
 	"context"
 	"fmt"
+	"log/slog"
 	"maps"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
 	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/BushSchoolIT/extractor/blackbaud"
+	"github.com/BushSchoolIT/extractor/metrics"
+	"github.com/BushSchoolIT/extractor/secrets"
+	"github.com/BushSchoolIT/extractor/tracing"
+	"github.com/jackc/pgpassfile"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type State struct {
 	Ctx  *context.Context
 	Conn *pgx.Conn
+	// the job and run that rejected rows are quarantined under
+	Job   string
+	RunID string
+	// number of rows that may fail to insert in a run before the load is aborted
+	ErrorBudget int
+	// largest drop in rows, compared to the table and the last successful run, allowed before a load aborts
+	MaxShrinkPercent float64
+	// load even when the row count guard trips
+	Force bool
+	// the run only loads rows changed since the job's watermark, so row counts aren't comparable to full runs
+	Incremental bool
+	// what to do when a list's columns changed, SCHEMA_DRIFT_FAIL or SCHEMA_DRIFT_WARN
+	SchemaDrift string
+	// wait for other runs to release the job's table locks instead of failing
+	LockWait bool
+	// how rows deleted in blackbaud are propagated, off when Mode is empty
+	Sync SyncConfig
+	// the job's tables are staged, its queries resolve to the copies in the staging schema until they are swapped
+	Staged bool
+	// the serve schedule that started the run and which attempt it is, recorded with the run
+	Schedule string
+	Attempt  int
+	// called once the run's result is recorded, e.g. to send notifications
+	OnFinish func(RunResult)
+
+	rejects    []RejectedRow
+	failedRows int
+	rowsIn     *int
+	// rows upserted per table by the open transaction, see begin and commit
+	upserted map[string]int
+	summary  map[string]any
+	// serializes the connection for stores used from several goroutines
+	connLock *sync.Mutex
+	// when StartRun recorded the run
+	startedAt time.Time
+	// the pool connection Conn belongs to, released by Close
+	pooled *pgxpool.Conn
 }
 
+// the password is looked up in the pgpass file, by PGPASSFILE or at its default location
+const PGPASS string = "pgpass"
+
 type Config struct {
-	User     string `json:"user"`
-	Port     string `json:"port"`
+	User string `json:"user"`
+	Port string `json:"port"`
+	// the password, a secret reference like env:PGPASSWORD or file:/run/secrets/pg, or pgpass to look it up in the pgpass file
 	Password string `json:"password"`
 	Addr     string `json:"address"`
 	Name     string `json:"database"`
 }
 
+// escaped so passwords with characters like @ or / still connect
+func (c Config) url() string {
+	u := url.URL{
+		Scheme: "postgres",
+		User:   url.UserPassword(c.User, c.Password),
+		Host:   net.JoinHostPort(c.Addr, c.Port),
+		Path:   "/" + c.Name,
+	}
+	return u.String()
+}
+
+// replaces a secret reference in Password with the password it points to
+func (c *Config) ResolveSecrets() error {
+	if c.Password != PGPASS {
+		password, err := secrets.Resolve(c.Password)
+		c.Password = password
+		return err
+	}
+	path := os.Getenv("PGPASSFILE")
+	if path == "" {
+		path = defaultPgpassFile()
+	}
+	passfile, err := pgpassfile.ReadPassfile(path)
+	if err != nil {
+		return fmt.Errorf("unable to read pgpass file: %v", err)
+	}
+	password := passfile.FindPassword(c.Addr, c.Port, c.Name, c.User)
+	if password == "" {
+		return fmt.Errorf("%s has no password for %s:%s:%s:%s", path, c.Addr, c.Port, c.Name, c.User)
+	}
+	secrets.Register(password)
+	c.Password = password
+	return nil
+}
+
+// where libpq looks for the pgpass file when PGPASSFILE isn't set
+func defaultPgpassFile() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("APPDATA"), "postgresql", "pgpass.conf")
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".pgpass")
+}
+
 func Connect(c Config) (State, error) {
-	connUrl := fmt.Sprintf("postgres://%s:%s@%s:%s/%s", c.User, c.Password, c.Addr, c.Port, c.Name)
 	ctx := context.Background()
-	conn, err := pgx.Connect(ctx, connUrl)
+	conn, err := pgx.Connect(ctx, c.url())
+	if err != nil {
+		return State{}, err
+	}
+	return State{
+		Ctx:      &ctx,
+		Conn:     conn,
+		connLock: &sync.Mutex{},
+	}, nil
+}
+
+// how long Reconnect waits on the old connection before giving up on it
+const PING_TIMEOUT = 10 * time.Second
+
+/*
+Replaces the connection with a new one unless it still answers, so long running processes such as
+worker survive a DB restart or a network blip. Not for connections acquired from a pool.
+*/
+func (db *State) Reconnect(c Config) error {
+	ctx, cancel := context.WithTimeout(*db.Ctx, PING_TIMEOUT)
+	defer cancel()
+	if !db.Conn.IsClosed() && db.Conn.Ping(ctx) == nil {
+		return nil
+	}
+	db.Conn.Close(ctx)
+	conn, err := pgx.Connect(*db.Ctx, c.url())
+	if err != nil {
+		return err
+	}
+	db.Conn = conn
+	return nil
+}
+
+// a pool of up to size connections shared by jobs run in one process
+func NewPool(c Config, size int32) (*pgxpool.Pool, error) {
+	poolConfig, err := pgxpool.ParseConfig(c.url())
+	if err != nil {
+		return nil, err
+	}
+	poolConfig.MaxConns = max(size, 1)
+	return pgxpool.NewWithConfig(context.Background(), poolConfig)
+}
+
+/*
+Takes a connection from the pool for a job to hold until Close. Locks and the search path are per
+session so a job keeps the same connection throughout, Close clears them before handing it back.
+*/
+func Acquire(pool *pgxpool.Pool) (State, error) {
+	ctx := context.Background()
+	conn, err := pool.Acquire(ctx)
 	if err != nil {
 		return State{}, err
 	}
 	return State{
-		Ctx:  &ctx,
-		Conn: conn,
+		Ctx:      &ctx,
+		Conn:     conn.Conn(),
+		connLock: &sync.Mutex{},
+		pooled:   conn,
 	}, nil
 }
 
@@ -47,17 +197,35 @@ func (db *State) QueryGrades(grades []int32) (pgx.Rows, error) {
 }
 
 func (db *State) Close() error {
-	return db.Conn.Close(*db.Ctx)
+	if db.pooled == nil {
+		return db.Conn.Close(*db.Ctx)
+	}
+	defer db.pooled.Release()
+	_, err := db.Conn.Exec(context.Background(), `SELECT pg_advisory_unlock_all(); RESET ALL;`)
+	if err != nil {
+		// the pool drops closed connections instead of reusing them
+		return db.Conn.Close(context.Background())
+	}
+	return nil
 }
 
-func (db *State) InsertEmails(t blackbaud.UnorderedTable) error {
-	tx, err := db.Conn.BeginTx(*db.Ctx, pgx.TxOptions{})
+func (db *State) InsertEmails(t blackbaud.UnorderedTable) (err error) {
+	defer db.saveRejects()
+	defer metrics.Since(metrics.TransactionDuration.WithLabelValues(db.Job), time.Now())
+	_, span := tracing.Start(*db.Ctx, "load", attribute.String("table", "parents"))
+	defer func() { tracing.End(span, err) }()
+	tx, err := db.begin()
 	if err != nil {
 		return err
 	}
 	primaryKeys := map[string]bool{
 		"email": true,
 	}
+	err = db.checkRowCount(tx, len(t.Rows), &rowScope{table: "parents", incoming: len(t.Rows)})
+	if err != nil {
+		tx.Rollback(*db.Ctx)
+		return err
+	}
 
 	// remove all emails to do a full sync
 	cmd, err := tx.Exec(*db.Ctx, `TRUNCATE TABLE parents;`)
@@ -66,7 +234,7 @@ func (db *State) InsertEmails(t blackbaud.UnorderedTable) error {
 		return fmt.Errorf("failed to truncate parent db: %v, cmd: %s", err, cmd.String())
 	}
 	// remove null primary keys
-	removeNull(primaryKeys, t)
+	t = db.removeNull(primaryKeys, t)
 	query := fmt.Sprintf(`
 	INSERT INTO parents (%s) VALUES (%s)
 	ON CONFLICT (%s)
@@ -74,27 +242,37 @@ func (db *State) InsertEmails(t blackbaud.UnorderedTable) error {
 		strings.Join(t.Columns, ","),
 		placeHolders(len(t.Columns)),
 		strings.Join(slices.Collect(maps.Keys(primaryKeys)), ","),
-		updateAssignments(t.Columns, primaryKeys),
+		updateAssignments("parents", t, primaryKeys),
 	)
-	err = insertRows(db.Ctx, tx, t.Rows, query)
+	err = db.insertRows(tx, "parents", t, query)
 	if err != nil {
 		tx.Rollback(*db.Ctx)
 		return err
 	}
-	return tx.Commit(*db.Ctx)
+	return db.commit(tx)
 }
 
-func (db *State) InsertAttendance(t blackbaud.UnorderedTable) error {
-	tx, err := db.Conn.BeginTx(*db.Ctx, pgx.TxOptions{})
+func (db *State) InsertAttendance(t blackbaud.UnorderedTable) (err error) {
+	defer db.saveRejects()
+	defer metrics.Since(metrics.TransactionDuration.WithLabelValues(db.Job), time.Now())
+	ctx, span := tracing.Start(*db.Ctx, "load", attribute.String("table", "attendance"))
+	defer func() { tracing.End(span, err) }()
+	if db.Sync.Mode != "" && db.Sync.ScopeColumn == "" {
+		return fmt.Errorf("syncing attendance deletions needs a scope_column, it only pulls one day")
+	}
+	tx, err := db.begin()
 	if err != nil {
 		return err
 	}
 	primaryKeys := map[string]bool{
 		"id": true,
 	}
+	// attendance only ever inserts the day's rows, so there's nothing to guard but the count is still recorded
+	incoming := len(t.Rows)
+	db.rowsIn = &incoming
 
 	// remove null primary keys
-	removeNull(primaryKeys, t)
+	t = db.removeNull(primaryKeys, t)
 	query := fmt.Sprintf(`
 	INSERT INTO attendance (%s) VALUES (%s)
 	ON CONFLICT (%s)
@@ -103,12 +281,19 @@ func (db *State) InsertAttendance(t blackbaud.UnorderedTable) error {
 		placeHolders(len(t.Columns)),
 		strings.Join(slices.Collect(maps.Keys(primaryKeys)), ","),
 	)
-	err = insertRows(db.Ctx, tx, t.Rows, query)
+	err = db.insertRows(tx, "attendance", t, query)
+	if err != nil {
+		tx.Rollback(*db.Ctx)
+		return err
+	}
+	_, err = transform(ctx, "sync_attendance", func() (string, error) {
+		return "", db.syncDeletions(tx, "attendance", slices.Sorted(maps.Keys(primaryKeys)), []blackbaud.UnorderedTable{t}, "")
+	})
 	if err != nil {
 		tx.Rollback(*db.Ctx)
 		return err
 	}
-	return tx.Commit(*db.Ctx)
+	return db.commit(tx)
 }
 
 // Build SQL placeholders like $1, $2, ..., $N
@@ -120,38 +305,119 @@ func placeHolders(count int) string {
 	return strings.Join(placeholders, ",")
 }
 
-func removeNull(keys map[string]bool, t blackbaud.UnorderedTable) {
-	for i := len(t.Rows) - 1; i >= 0; i-- {
-		row := t.Rows[i]
-		for j, col := range row {
-			if keys[t.Columns[j]] && col == nil {
-				t.Rows = slices.Delete(t.Rows, i, i+1)
-				break
-			}
-		}
-	}
-}
-
-func updateAssignments(columns []string, conflicts map[string]bool) string {
+// columns only some merged lists had keep the stored value for the rows from the lists without them
+func updateAssignments(table string, t blackbaud.UnorderedTable, conflicts map[string]bool) string {
 	updateAssignments := ""
-	for _, col := range columns {
+	for _, col := range t.Columns {
 		if conflicts[col] {
 			continue // skip conflict key columns
 		}
 		if updateAssignments != "" {
 			updateAssignments += ", "
 		}
+		if slices.Contains(t.Partial, col) {
+			updateAssignments += fmt.Sprintf("%s = COALESCE(EXCLUDED.%s, %s.%s)", col, col, table, col)
+			continue
+		}
 		updateAssignments += fmt.Sprintf("%s = EXCLUDED.%s", col, col)
 	}
 	return updateAssignments
 }
 
-func (db *State) TranscriptOps(t blackbaud.UnorderedTable, startYear int, endYear int) error {
-	tx, err := db.Conn.BeginTx(*db.Ctx, pgx.TxOptions{})
+// drops the columns of t that table doesn't have, a column a list gained can only be loaded once it's added to the table
+func (db *State) tableColumns(tx pgx.Tx, table string, t blackbaud.UnorderedTable) (blackbaud.UnorderedTable, error) {
+	rows, err := tx.Query(*db.Ctx, `
+	SELECT attname::text FROM pg_attribute
+	WHERE attrelid = to_regclass($1) AND attnum > 0 AND NOT attisdropped`, table)
+	if err != nil {
+		return t, fmt.Errorf("unable to read the columns of %s: %v", table, err)
+	}
+	columns, err := pgx.CollectRows(rows, pgx.RowTo[string])
 	if err != nil {
+		return t, fmt.Errorf("unable to read the columns of %s: %v", table, err)
+	}
+	if len(columns) == 0 {
+		return t, fmt.Errorf("table %s does not exist", table)
+	}
+	return keepColumns(t, columns), nil
+}
+
+// t with only the given columns
+func keepColumns(t blackbaud.UnorderedTable, columns []string) blackbaud.UnorderedTable {
+	kept := blackbaud.UnorderedTable{}
+	index := []int{}
+	for i, col := range t.Columns {
+		if !slices.Contains(columns, col) {
+			slog.Warn("Dropping column the table doesn't have", slog.String("column", col))
+			continue
+		}
+		kept.Columns = append(kept.Columns, col)
+		index = append(index, i)
+		if slices.Contains(t.Partial, col) {
+			kept.Partial = append(kept.Partial, col)
+		}
+	}
+	if len(index) == len(t.Columns) {
+		return t
+	}
+	for _, row := range t.Rows {
+		newRow := make([]any, len(index))
+		for i, j := range index {
+			newRow[i] = row[j]
+		}
+		kept.Rows = append(kept.Rows, newRow)
+	}
+	return kept
+}
+
+type TranscriptOptions struct {
+	// academic year the transforms treat as current, e.g. 2024 and 2025 for "2024 - 2025"
+	StartYear int
+	EndYear   int
+	// number of academic years, counting back from EndYear, whose derived rows are rebuilt
+	Years int
+	// fail the transaction instead of warning when course codes are left without a transcript category
+	StrictCourseCodes bool
+	// some lists failed and were left out of the load (--continue-on-error)
+	PartialLists bool
+}
+
+func (db *State) TranscriptOps(t blackbaud.UnorderedTable, opts TranscriptOptions) (err error) {
+	defer db.saveRejects()
+	defer metrics.Since(metrics.TransactionDuration.WithLabelValues(db.Job), time.Now())
+	ctx, span := tracing.Start(*db.Ctx, "load", attribute.String("table", "transcripts"))
+	defer func() { tracing.End(span, err) }()
+	startYear, endYear := opts.StartYear, opts.EndYear
+	tx, err := db.begin()
+	if err != nil {
+		return err
+	}
+	// transcripts keeps years the lists no longer return, only the years being rebuilt are comparable
+	years := schoolYears(endYear, opts.Years)
+	err = db.checkRowCount(tx, len(t.Rows), &rowScope{
+		table:    "transcripts",
+		where:    `school_year = ANY($1)`,
+		args:     []any{years},
+		incoming: rowsInYears(t, years),
+	})
+	if err != nil {
+		tx.Rollback(*db.Ctx)
 		return err
 	}
-	cmd, err := transcriptCleanup(db.Ctx, tx, startYear, endYear)
+	// lists can carry columns the table doesn't have yet under --schema-drift=warn
+	t, err = db.tableColumns(tx, "transcripts", t)
+	if err != nil {
+		tx.Rollback(*db.Ctx)
+		return err
+	}
+	var students []int64
+	if db.Incremental || opts.PartialLists {
+		// the other students' rows weren't pulled so they wouldn't be reinserted
+		students = studentIDs(t)
+	}
+	cmd, err := transform(ctx, "transcript_cleanup", func() (string, error) {
+		return transcriptCleanup(db.Ctx, tx, startYear, endYear, opts.Years, students)
+	})
 	if err != nil {
 		tx.Rollback(*db.Ctx)
 		return fmt.Errorf("transcript cleanup failed: %v, cmd: %s", err, cmd)
@@ -166,7 +432,7 @@ func (db *State) TranscriptOps(t blackbaud.UnorderedTable, startYear int, endYea
 		"grade_id":        true,
 	}
 	// remove null primary keys
-	removeNull(primaryKeys, t)
+	t = db.removeNull(primaryKeys, t)
 	query := fmt.Sprintf(`
 	INSERT INTO transcripts (%s) VALUES (%s)
 	ON CONFLICT (%s)
@@ -174,39 +440,73 @@ func (db *State) TranscriptOps(t blackbaud.UnorderedTable, startYear int, endYea
 		strings.Join(t.Columns, ","),
 		placeHolders(len(t.Columns)),
 		strings.Join(slices.Collect(maps.Keys(primaryKeys)), ","),
-		updateAssignments(t.Columns, primaryKeys),
+		updateAssignments("transcripts", t, primaryKeys),
 	)
 
-	err = insertRows(db.Ctx, tx, t.Rows, query)
+	err = db.insertRows(tx, "transcripts", t, query)
 	if err != nil {
 		tx.Rollback(*db.Ctx)
 		return err
 	}
-	cmd, err = fixNoYearlong(db.Ctx, tx)
+	// before the fixes add their derived rows, which aren't in the source
+	_, err = transform(ctx, "sync_transcripts", func() (string, error) {
+		return "", db.syncDeletions(tx, "transcripts", slices.Sorted(maps.Keys(primaryKeys)), []blackbaud.UnorderedTable{t},
+			`x.school_year = ANY($1)`, years)
+	})
+	if err != nil {
+		tx.Rollback(*db.Ctx)
+		return err
+	}
+	cmd, err = transform(ctx, "fix_no_yearlong", func() (string, error) { return fixNoYearlong(db.Ctx, tx) })
 	if err != nil {
 		tx.Rollback(*db.Ctx)
 		return fmt.Errorf("fixing yearlong courses failed: %v, cmd: %s", err, cmd)
 	}
-	cmd, err = fixNonstandardGrades(db.Ctx, tx)
+	cmd, err = transform(ctx, "fix_nonstandard_grades", func() (string, error) { return fixNonstandardGrades(db.Ctx, tx) })
 	if err != nil {
 		tx.Rollback(*db.Ctx)
 		return fmt.Errorf("unable to fix nonstandard grades: %v, cmd: %s", err, cmd)
 	}
-	cmd, err = fixFallYearlongs(db.Ctx, tx, startYear, endYear)
+	cmd, err = transform(ctx, "fix_fall_yearlongs", func() (string, error) {
+		return fixFallYearlongs(db.Ctx, tx, startYear, endYear)
+	})
 	if err != nil {
 		tx.Rollback(*db.Ctx)
 		return fmt.Errorf("unable to fix fall yearlongs: %v, cmd: %s", err, cmd)
 	}
-	cmd, err = insertMissingTranscriptCategories(db.Ctx, tx)
+	cmd, err = transform(ctx, "insert_missing_transcript_categories", func() (string, error) {
+		return insertMissingTranscriptCategories(db.Ctx, tx)
+	})
 	if err != nil {
 		tx.Rollback(*db.Ctx)
 		return fmt.Errorf("unable to insert missing transcript categories: %v, cmd: %s", err, cmd)
 	}
-	return tx.Commit(*db.Ctx)
+	unmapped, err := unmappedCourseCodes(db.Ctx, tx)
+	if err != nil {
+		tx.Rollback(*db.Ctx)
+		return fmt.Errorf("unable to check for unmapped course codes: %v", err)
+	}
+	missing := 0
+	for _, code := range unmapped {
+		if code.NaNRows == 0 {
+			continue
+		}
+		missing++
+		slog.Warn("Course code has no transcript category mapping", slog.String("course_code", code.CourseCode), slog.Int("students", code.Students), slog.Int("rows", code.NaNRows))
+	}
+	if missing > 0 && opts.StrictCourseCodes {
+		tx.Rollback(*db.Ctx)
+		return fmt.Errorf("%d course codes have no transcript category, add them with course-codes import", missing)
+	}
+	return db.commit(tx)
 }
 
-func (db *State) EnrollmentOps(enrolled blackbaud.UnorderedTable, departed blackbaud.UnorderedTable) error {
-	tx, err := db.Conn.BeginTx(*db.Ctx, pgx.TxOptions{})
+func (db *State) EnrollmentOps(enrolled blackbaud.UnorderedTable, departed blackbaud.UnorderedTable) (err error) {
+	defer db.saveRejects()
+	defer metrics.Since(metrics.TransactionDuration.WithLabelValues(db.Job), time.Now())
+	ctx, span := tracing.Start(*db.Ctx, "load", attribute.String("table", "enrollment"))
+	defer func() { tracing.End(span, err) }()
+	tx, err := db.begin()
 	if err != nil {
 		return err
 	}
@@ -214,7 +514,14 @@ func (db *State) EnrollmentOps(enrolled blackbaud.UnorderedTable, departed black
 	primaryKeys := map[string]bool{
 		"student_user_id": true,
 	}
-	removeNull(primaryKeys, enrolled)
+	// enrollment keeps every student who ever enrolled, so only the last run is a fair baseline
+	err = db.checkRowCount(tx, len(enrolled.Rows)+len(departed.Rows), nil)
+	if err != nil {
+		tx.Rollback(*db.Ctx)
+		return err
+	}
+	enrolled = db.removeNull(primaryKeys, enrolled)
+	departed = db.removeNull(primaryKeys, departed)
 	enrolledInsert := fmt.Sprintf(`
 	INSERT INTO enrollment (%s) VALUES (%s)
 	ON CONFLICT (%s)
@@ -222,9 +529,9 @@ func (db *State) EnrollmentOps(enrolled blackbaud.UnorderedTable, departed black
 		strings.Join(enrolled.Columns, ","),
 		placeHolders(len(enrolled.Columns)),
 		strings.Join(slices.Collect(maps.Keys(primaryKeys)), ","),
-		updateAssignments(enrolled.Columns, primaryKeys),
+		updateAssignments("enrollment", enrolled, primaryKeys),
 	)
-	err = insertRows(db.Ctx, tx, enrolled.Rows, enrolledInsert)
+	err = db.insertRows(tx, "enrollment", enrolled, enrolledInsert)
 	if err != nil {
 		tx.Rollback(*db.Ctx)
 		return err
@@ -236,30 +543,27 @@ func (db *State) EnrollmentOps(enrolled blackbaud.UnorderedTable, departed black
 		strings.Join(departed.Columns, ","),
 		placeHolders(len(departed.Columns)),
 		strings.Join(slices.Collect(maps.Keys(primaryKeys)), ","),
-		updateAssignments(departed.Columns, primaryKeys),
+		updateAssignments("enrollment", departed, primaryKeys),
 	)
-	err = insertRows(db.Ctx, tx, departed.Rows, departedInsert)
+	err = db.insertRows(tx, "enrollment", departed, departedInsert)
 	if err != nil {
 		tx.Rollback(*db.Ctx)
 		return err
 	}
-	err = concatGradStatus(db.Ctx, tx)
+	_, err = transform(ctx, "sync_enrollment", func() (string, error) {
+		return "", db.syncDeletions(tx, "enrollment", slices.Sorted(maps.Keys(primaryKeys)), []blackbaud.UnorderedTable{enrolled, departed}, "")
+	})
 	if err != nil {
 		tx.Rollback(*db.Ctx)
 		return err
 	}
-
-	return tx.Commit(*db.Ctx)
-}
-
-func insertRows(ctx *context.Context, tx pgx.Tx, rows [][]any, insert string) error {
-	for _, row := range rows {
-		cmd, err := tx.Exec(*ctx, insert, row...)
-		if err != nil {
-			return fmt.Errorf("db insert failed: %v, cmd: %s, query: %s", err, cmd.String(), insert)
-		}
+	_, err = transform(ctx, "concat_grad_status", func() (string, error) { return "", concatGradStatus(db.Ctx, tx) })
+	if err != nil {
+		tx.Rollback(*db.Ctx)
+		return err
 	}
-	return nil
+
+	return db.commit(tx)
 }
 
 /*
@@ -275,7 +579,7 @@ Logic:
 */
 func concatGradStatus(ctx *context.Context, tx pgx.Tx) error {
 	_, err := tx.Exec(*ctx, `
-    UPDATE public.enrollment
+    UPDATE enrollment
     SET graduated_status = CASE
         WHEN NOT graduated AND grad_year IS NULL AND depart_date IS NOT NULL
             THEN 'Departed ' || TO_CHAR(depart_date::date, 'MM-DD-YYYY')
@@ -291,8 +595,12 @@ func concatGradStatus(ctx *context.Context, tx pgx.Tx) error {
 	return nil
 }
 
-func (db *State) TranscriptCommentOps(t blackbaud.UnorderedTable) error {
-	tx, err := db.Conn.BeginTx(*db.Ctx, pgx.TxOptions{})
+func (db *State) TranscriptCommentOps(t blackbaud.UnorderedTable) (err error) {
+	defer db.saveRejects()
+	defer metrics.Since(metrics.TransactionDuration.WithLabelValues(db.Job), time.Now())
+	ctx, span := tracing.Start(*db.Ctx, "load", attribute.String("table", "transcript_comments"))
+	defer func() { tracing.End(span, err) }()
+	tx, err := db.begin()
 	if err != nil {
 		return err
 	}
@@ -301,8 +609,14 @@ func (db *State) TranscriptCommentOps(t blackbaud.UnorderedTable) error {
 	primaryKeys := map[string]bool{
 		"student_user_id": true,
 	}
+	// comments of students no longer in the list are kept, so only the last run is a fair baseline
+	err = db.checkRowCount(tx, len(t.Rows), nil)
+	if err != nil {
+		tx.Rollback(*db.Ctx)
+		return err
+	}
 	// remove null primary keys
-	removeNull(primaryKeys, t)
+	t = db.removeNull(primaryKeys, t)
 	query := fmt.Sprintf(`
 	INSERT INTO transcript_comments (%s) VALUES (%s)
 	ON CONFLICT (%s)
@@ -310,43 +624,22 @@ func (db *State) TranscriptCommentOps(t blackbaud.UnorderedTable) error {
 		strings.Join(t.Columns, ","),
 		placeHolders(len(t.Columns)),
 		strings.Join(slices.Collect(maps.Keys(primaryKeys)), ","),
-		updateAssignments(t.Columns, primaryKeys),
+		updateAssignments("transcript_comments", t, primaryKeys),
 	)
 
-	err = insertRows(db.Ctx, tx, t.Rows, query)
+	err = db.insertRows(tx, "transcript_comments", t, query)
 	if err != nil {
 		tx.Rollback(*db.Ctx)
 		return err
 	}
-	return tx.Commit(*db.Ctx)
-}
-
-func (db *State) GpaCalculation() error {
-	_, err := db.Conn.Exec(*db.Ctx, `
-INSERT INTO public.gpa (student_user_id, calculated_gpa)
-SELECT 
-  student_user_id,
-ROUND((SUM(score::NUMERIC * credits::NUMERIC) / NULLIF(SUM(credits::NUMERIC), 0))::NUMERIC, 2)
-FROM (
-  SELECT
-    student_user_id,
-    score::NUMERIC,
-    CASE 
-      WHEN grade_description = 'Year-Long Grades' THEN 2::NUMERIC
-      ELSE 1::NUMERIC
-    END AS credits
-  FROM public.transcripts
-  WHERE grade_description NOT IN ('Fall Term Grades YL', 'Spring Term Grades YL')
-    AND grade_id != 999999
-    AND grade IN ('A', 'A-', 'B+', 'B', 'B-', 'C+', 'C', 'C-', 'D+', 'D', 'D-', 'F', 'WF', 'NC')
-) AS weighted
-GROUP BY student_user_id
-ON CONFLICT (student_user_id)
-DO UPDATE SET calculated_gpa = EXCLUDED.calculated_gpa;`)
+	_, err = transform(ctx, "sync_transcript_comments", func() (string, error) {
+		return "", db.syncDeletions(tx, "transcript_comments", slices.Sorted(maps.Keys(primaryKeys)), []blackbaud.UnorderedTable{t}, "")
+	})
 	if err != nil {
+		tx.Rollback(*db.Ctx)
 		return err
 	}
-	return nil
+	return db.commit(tx)
 }
 
 // transformation used in the transcript ETL, used for taking yearlong courses with only 1 grade and fixing them to have both grades and be graded for both semesters
@@ -354,13 +647,13 @@ func fixNoYearlong(ctx *context.Context, tx pgx.Tx) (string, error) {
 	cmd, err := tx.Exec(*ctx, `
 		WITH potential_updates AS (
 			SELECT student_user_id, school_year, course_id
-			FROM public.transcripts
+			FROM transcripts
 			WHERE grade_description IN ('Fall Term Grades YL', 'Spring Term Grades YL', 'Year-Long Grades')
 				OR grade_id = 999999
 			GROUP BY student_user_id, school_year, course_id
 			HAVING COUNT(*) = 1
 		)
-		UPDATE public.transcripts t
+		UPDATE transcripts t
 		SET grade_description = 'no_yearlong_possible',
 			grade_id = 888888
 		FROM potential_updates p
@@ -383,7 +676,7 @@ WITH transcript_grades AS (
             WHEN grade IN ('NC', 'CR', 'I', 'WF', 'WP', 'AU') THEN 'non_letter'
             ELSE 'letter'
         END AS grade_type
-    FROM public.transcripts t
+    FROM transcripts t
     WHERE grade_description IN ('Fall Term Grades YL', 'Spring Term Grades YL', 'Year-Long Grades')
 ),
 paired_grades AS (
@@ -397,7 +690,7 @@ paired_grades AS (
     GROUP BY student_user_id, school_year, course_id
     HAVING COUNT(*) = 2 AND COUNT(DISTINCT grade_type) = 2
 )
-UPDATE public.transcripts t
+UPDATE transcripts t
 SET grade_description = 'no_yearlong_possible',
     grade_id = 777777
 FROM paired_grades p
@@ -417,7 +710,7 @@ by YL grades.
 func fixFallYearlongs(ctx *context.Context, tx pgx.Tx, startYear int, endYear int) (string, error) {
 	yearStr := fmt.Sprintf("%d - %d", startYear, endYear)
 	cmd, err := tx.Exec(*ctx, `
-		UPDATE public.transcripts
+		UPDATE transcripts
         SET grade_description = 'current_fall_yl',
         grade_id = 666666
         WHERE (school_year = $1 AND
@@ -430,30 +723,34 @@ func fixFallYearlongs(ctx *context.Context, tx pgx.Tx, startYear int, endYear in
 /*
 This function tx *pgx.Tx, removes records with grade_id = 999999, 888888, 777777, 666666 and restores Fall YL grades.
 This is done to prevent duplicates on a reimport because the grade_id is part of the primary key.
+When students is not nil, as on incremental runs, only their rows are removed since only theirs were pulled.
 */
-func transcriptCleanup(ctx *context.Context, tx pgx.Tx, startYear int, endYear int) (string, error) {
-	// List of the the last 4 academic years
-	yearList := []int{}
-	for i := range 5 {
-		yearList = append(yearList, endYear-i)
+func transcriptCleanup(ctx *context.Context, tx pgx.Tx, startYear int, endYear int, years int, students []int64) (string, error) {
+	studentFilter := ""
+	if students != nil {
+		studentFilter = "AND student_user_id = ANY($2)"
 	}
 	transcript_query := `
-                DELETE FROM public.transcripts
+                DELETE FROM transcripts
                                      WHERE (grade_id = 888888
                                      OR grade_id = 777777
                                      OR grade_id = 666666
                                      OR grade_description = 'Senior Mid-Term Grades')
                                      AND school_year = $1
-	`
-	for _, year := range yearList {
-		cmd, err := tx.Exec(*ctx, transcript_query, fmt.Sprintf("%d - %d", year, year+1))
+	` + studentFilter
+	for _, year := range schoolYears(endYear, years) {
+		args := []any{year}
+		if students != nil {
+			args = append(args, students)
+		}
+		cmd, err := tx.Exec(*ctx, transcript_query, args...)
 		if err != nil {
 			return cmd.String(), err
 		}
 	}
 
 	restoreFallYlQuery := `
-UPDATE public.transcripts
+UPDATE transcripts
     SET grade_description = 'Fall Term Grades YL', grade_id = 2154180
     WHERE (school_year != $1 
     AND grade_id = 666666);
@@ -462,14 +759,83 @@ UPDATE public.transcripts
 	if err != nil {
 		return cmd.String(), err
 	}
+	if students != nil {
+		cmd, err = tx.Exec(*ctx, `
+DELETE FROM transcripts
+    WHERE grade_id = 999999
+    AND student_user_id = ANY($1)
+	`, students)
+		return cmd.String(), err
+	}
 	deleteScheduledCoursesQuery := `
-DELETE FROM public.transcripts
+DELETE FROM transcripts
     WHERE grade_id = 999999
 	`
 	cmd, err = tx.Exec(*ctx, deleteScheduledCoursesQuery)
 	return cmd.String(), err
 }
 
+// the distinct student_user_id values in t
+func studentIDs(t blackbaud.UnorderedTable) []int64 {
+	ids, seen := []int64{}, map[int64]bool{}
+	i := slices.Index(t.Columns, "student_user_id")
+	if i == -1 {
+		return ids
+	}
+	for _, row := range t.Rows {
+		var id int64
+		switch v := row[i].(type) {
+		case float64:
+			id = int64(v)
+		case string:
+			parsed, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				continue
+			}
+			id = parsed
+		default:
+			continue
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// runs a named transform in its own span, recording its duration in metrics.TransformDuration
+func transform(ctx context.Context, name string, fn func() (string, error)) (cmd string, err error) {
+	defer metrics.Since(metrics.TransformDuration.WithLabelValues(name), time.Now())
+	_, span := tracing.Start(ctx, name)
+	defer func() { tracing.End(span, err) }()
+	return fn()
+}
+
+// the rows of t whose school_year is one of years
+func rowsInYears(t blackbaud.UnorderedTable, years []string) int {
+	i := slices.Index(t.Columns, "school_year")
+	if i == -1 {
+		return 0
+	}
+	count := 0
+	for _, row := range t.Rows {
+		if year, ok := row[i].(string); ok && slices.Contains(years, year) {
+			count++
+		}
+	}
+	return count
+}
+
+// the academic years in the backfill window, ending with the current one, e.g. "2024 - 2025"
+func schoolYears(endYear int, years int) []string {
+	yearList := []string{}
+	for i := range years {
+		yearList = append(yearList, fmt.Sprintf("%d - %d", endYear-i-1, endYear-i))
+	}
+	return yearList
+}
+
 /*
 This function tx *pgx.Tx, will insert transcript categories where none exist.
 This is always the case for grade_id = 999999 as they do not exist for scheduled courses.
@@ -485,19 +851,19 @@ func insertMissingTranscriptCategories(ctx *context.Context, tx pgx.Tx) (string,
                 course_codes.transcript_category,
                 ROW_NUMBER() OVER (PARTITION BY transcripts.course_code ORDER BY LENGTH(course_codes.course_prefix) DESC) AS rn
             FROM
-                public.transcripts
+                transcripts
             JOIN
-                public.course_codes
+                course_codes
             ON
                 transcripts.course_code::text LIKE course_codes.course_prefix || '%'
             WHERE
                 transcripts.transcript_category = 'NaN'
         )
-        UPDATE public.transcripts
+        UPDATE transcripts
         SET transcript_category = ranked_prefixes.transcript_category
         FROM ranked_prefixes
-        WHERE public.transcripts.course_code = ranked_prefixes.course_code
-        AND public.transcripts.transcript_category = 'NaN'
+        WHERE transcripts.course_code = ranked_prefixes.course_code
+        AND transcripts.transcript_category = 'NaN'
         AND ranked_prefixes.rn = 1;
 	`)
 	return cmd.String(), err
@@ -0,0 +1,40 @@
+package database
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/BushSchoolIT/extractor/blackbaud"
+)
+
+func TestUpdateAssignmentsKeepsPartialColumns(t *testing.T) {
+	merged := blackbaud.Merge(
+		blackbaud.UnorderedTable{Columns: []string{"id", "grade"}, Rows: [][]any{{1, "A"}}},
+		blackbaud.UnorderedTable{Columns: []string{"id", "grade", "comment"}, Rows: [][]any{{2, "B", "late"}}},
+	)
+	got := updateAssignments("transcripts", merged, map[string]bool{"id": true})
+	want := "grade = EXCLUDED.grade, comment = COALESCE(EXCLUDED.comment, transcripts.comment)"
+	if got != want {
+		t.Errorf("updateAssignments = %q, want %q", got, want)
+	}
+}
+
+func TestKeepColumnsDropsUnknownColumns(t *testing.T) {
+	merged := blackbaud.Merge(
+		blackbaud.UnorderedTable{Columns: []string{"id", "grade"}, Rows: [][]any{{1, "A"}}},
+		blackbaud.UnorderedTable{Columns: []string{"id", "new_field", "grade"}, Rows: [][]any{{2, "x", "B"}}},
+	)
+	kept := keepColumns(merged, []string{"id", "grade", "comment"})
+	if !slices.Equal(kept.Columns, []string{"id", "grade"}) {
+		t.Fatalf("columns = %v", kept.Columns)
+	}
+	if !slices.Equal(kept.Rows[0], []any{1, "A"}) || !slices.Equal(kept.Rows[1], []any{2, "B"}) {
+		t.Errorf("rows = %v", kept.Rows)
+	}
+	if len(kept.Partial) != 0 {
+		t.Errorf("partial = %v, the dropped column shouldn't stay partial", kept.Partial)
+	}
+	if got := updateAssignments("transcripts", kept, map[string]bool{"id": true}); got != "grade = EXCLUDED.grade" {
+		t.Errorf("updateAssignments = %q", got)
+	}
+}
@@ -0,0 +1,208 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/BushSchoolIT/extractor/metrics"
+	"github.com/BushSchoolIT/extractor/tracing"
+	"github.com/jackc/pgx/v5"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+/*
+A named GPA calculation. Every definition is written to public.gpa under its own name so
+counseling can report unweighted, weighted and core-only GPAs side by side.
+
+  - Scale maps a letter grade to grade points, when it is empty the transcript's score column is used
+  - Grades limits which letter grades count, when it is empty the keys of Scale are used
+  - Credits maps a grade_description to its credit weight, anything else gets DefaultCredits
+  - Weights add a bonus to passing grades for courses matching a course_code LIKE pattern (honors/AP)
+  - ExcludeDescriptions drops grade descriptions entirely (e.g. the YL term grades that are superseded)
+  - Categories, when set, only includes those transcript categories
+*/
+type GpaDefinition struct {
+	Name                string             `json:"name"`
+	Scale               map[string]float64 `json:"scale"`
+	Grades              []string           `json:"grades"`
+	Credits             map[string]float64 `json:"credits"`
+	DefaultCredits      float64            `json:"default_credits"`
+	Weights             []GpaWeight        `json:"weights"`
+	ExcludeDescriptions []string           `json:"exclude_descriptions"`
+	Categories          []string           `json:"transcript_categories"`
+}
+
+type GpaWeight struct {
+	CourseCodeLike string  `json:"course_code_like"`
+	Bonus          float64 `json:"bonus"`
+}
+
+// the calculation we used before definitions were configurable, used when the config doesn't list any
+var DEFAULT_GPA_DEFINITIONS = []GpaDefinition{
+	{
+		Name:                "default",
+		Grades:              []string{"A", "A-", "B+", "B", "B-", "C+", "C", "C-", "D+", "D", "D-", "F", "WF", "NC"},
+		Credits:             map[string]float64{"Year-Long Grades": 2},
+		DefaultCredits:      1,
+		ExcludeDescriptions: []string{"Fall Term Grades YL", "Spring Term Grades YL"},
+	},
+}
+
+func (d GpaDefinition) grades() []string {
+	if len(d.Grades) > 0 {
+		return d.Grades
+	}
+	grades := []string{}
+	for grade := range d.Scale {
+		grades = append(grades, grade)
+	}
+	return grades
+}
+
+func (d GpaDefinition) Validate() error {
+	if d.Name == "" {
+		return fmt.Errorf("gpa definition is missing a name")
+	}
+	if len(d.grades()) == 0 {
+		return fmt.Errorf("gpa definition %s has neither a scale nor a list of grades", d.Name)
+	}
+	if d.DefaultCredits < 0 {
+		return fmt.Errorf("gpa definition %s has negative default credits", d.Name)
+	}
+	return nil
+}
+
+// arguments shared by every query built from gpaPointsQuery, in placeholder order
+func (d GpaDefinition) args() []any {
+	scale := d.Scale
+	if scale == nil {
+		scale = map[string]float64{}
+	}
+	credits := d.Credits
+	if credits == nil {
+		credits = map[string]float64{}
+	}
+	patterns := []string{}
+	bonuses := []float64{}
+	for _, w := range d.Weights {
+		patterns = append(patterns, w.CourseCodeLike)
+		bonuses = append(bonuses, w.Bonus)
+	}
+	exclude := d.ExcludeDescriptions
+	if exclude == nil {
+		exclude = []string{}
+	}
+	categories := d.Categories
+	if categories == nil {
+		categories = []string{}
+	}
+	return []any{d.Name, scale, credits, d.DefaultCredits, exclude, d.grades(), categories, patterns, bonuses}
+}
+
+/*
+Selects every transcript row counted by a definition along with its grade points and credits.
+Placeholders are the ones returned by GpaDefinition.args.
+*/
+const gpaPointsQuery = `
+SELECT
+  student_user_id,
+  school_year,
+  grade_description,
+  term_id,
+  CASE
+    WHEN base > 0 THEN base + COALESCE((
+      SELECT MAX(w.bonus)
+      FROM unnest($8::text[], $9::float8[]) AS w(pattern, bonus)
+      WHERE course_code LIKE w.pattern
+    ), 0)::NUMERIC
+    ELSE base
+  END AS points,
+  credits
+FROM (
+  SELECT
+    student_user_id,
+    school_year,
+    grade_description,
+    term_id,
+    course_code,
+    COALESCE(($2::jsonb ->> grade)::NUMERIC, score::NUMERIC) AS base,
+    COALESCE(($3::jsonb ->> grade_description)::NUMERIC, $4::NUMERIC) AS credits
+  FROM transcripts
+  WHERE grade_description <> ALL($5::text[])
+    AND grade_id != 999999
+    AND grade = ANY($6::text[])
+    AND (cardinality($7::text[]) = 0 OR transcript_category = ANY($7::text[]))
+) AS graded
+`
+
+func (db *State) GpaCalculation(definitions []GpaDefinition) (err error) {
+	tx, err := db.Conn.BeginTx(*db.Ctx, pgx.TxOptions{})
+	if err != nil {
+		return err
+	}
+	defer metrics.Since(metrics.TransactionDuration.WithLabelValues(db.Job), time.Now())
+	ctx, span := tracing.Start(*db.Ctx, "load", attribute.String("table", "gpa"))
+	defer func() { tracing.End(span, err) }()
+	for _, d := range definitions {
+		cmd, err := transform(ctx, "gpa_"+d.Name, func() (string, error) {
+			cmd, err := tx.Exec(*db.Ctx, fmt.Sprintf(`
+INSERT INTO gpa (student_user_id, definition, calculated_gpa)
+SELECT
+  student_user_id,
+  $1,
+  ROUND((SUM(points * credits) / NULLIF(SUM(credits), 0))::NUMERIC, 2)
+FROM (%s) AS weighted
+GROUP BY student_user_id
+ON CONFLICT (student_user_id, definition)
+DO UPDATE SET calculated_gpa = EXCLUDED.calculated_gpa;`, gpaPointsQuery), d.args()...)
+			return cmd.String(), err
+		})
+		if err != nil {
+			tx.Rollback(*db.Ctx)
+			return fmt.Errorf("gpa definition %s failed: %v, cmd: %s", d.Name, err, cmd)
+		}
+		historyCmd, err := transform(ctx, "gpa_history_"+d.Name, func() (string, error) { return gpaHistory(db.Ctx, tx, d) })
+		if err != nil {
+			tx.Rollback(*db.Ctx)
+			return fmt.Errorf("gpa history for definition %s failed: %v, cmd: %s", d.Name, err, historyCmd)
+		}
+	}
+	return tx.Commit(*db.Ctx)
+}
+
+/*
+Rebuilds public.gpa_history for a definition. Each row is one grading period (grade_description)
+of one school_year with the GPA earned in that period and the cumulative GPA up to and including it.
+Periods within a year are ordered by their earliest term_id, which follows the school calendar.
+*/
+func gpaHistory(ctx *context.Context, tx pgx.Tx, d GpaDefinition) (string, error) {
+	cmd, err := tx.Exec(*ctx, `DELETE FROM gpa_history WHERE definition = $1`, d.Name)
+	if err != nil {
+		return cmd.String(), err
+	}
+	cmd, err = tx.Exec(*ctx, fmt.Sprintf(`
+INSERT INTO gpa_history (student_user_id, definition, school_year, grading_period, term_gpa, term_credits, cumulative_gpa, cumulative_credits)
+SELECT
+  student_user_id,
+  $1,
+  school_year,
+  grade_description,
+  ROUND((term_points / NULLIF(term_credits, 0))::NUMERIC, 2),
+  term_credits,
+  ROUND((SUM(term_points) OVER running / NULLIF(SUM(term_credits) OVER running, 0))::NUMERIC, 2),
+  SUM(term_credits) OVER running
+FROM (
+  SELECT
+    student_user_id,
+    school_year,
+    grade_description,
+    MIN(term_id) AS first_term,
+    SUM(points * credits) AS term_points,
+    SUM(credits) AS term_credits
+  FROM (%s) AS weighted
+  GROUP BY student_user_id, school_year, grade_description
+) AS periods
+WINDOW running AS (PARTITION BY student_user_id ORDER BY school_year, first_term, grade_description);`, gpaPointsQuery), d.args()...)
+	return cmd.String(), err
+}
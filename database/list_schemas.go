@@ -0,0 +1,82 @@
+package database
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+
+	"github.com/BushSchoolIT/extractor/blackbaud"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// a list whose columns changed fails the run and its stored schema is kept
+	SCHEMA_DRIFT_FAIL string = "fail"
+	// a list whose columns changed is logged and its stored schema is updated
+	SCHEMA_DRIFT_WARN string = "warn"
+)
+
+/*
+Compares a list's columns with the ones stored in public.list_schemas by the last run. New lists are
+recorded, changed lists fail or warn depending on SchemaDrift (failing unless it's SCHEMA_DRIFT_WARN).
+*/
+func (db *State) CheckListSchema(id string, columns []string) error {
+	if len(columns) == 0 {
+		return nil // empty lists have no columns to compare
+	}
+	fingerprint := blackbaud.Fingerprint(columns)
+	var (
+		stored            []string
+		storedFingerprint string
+	)
+	err := db.Conn.QueryRow(*db.Ctx, `
+		SELECT columns, fingerprint
+		FROM list_schemas
+		WHERE list_id = $1`, id).Scan(&stored, &storedFingerprint)
+	switch {
+	case err == pgx.ErrNoRows:
+		slog.Info("Recording list schema", slog.String("list_id", id), slog.String("fingerprint", fingerprint))
+	case err != nil:
+		return fmt.Errorf("unable to get stored schema for list %s: %v", id, err)
+	case storedFingerprint == fingerprint:
+		return nil
+	default:
+		added, removed := columnChanges(stored, columns)
+		attrs := []any{
+			slog.String("list_id", id),
+			slog.Any("added", added),
+			slog.Any("removed", removed),
+			slog.Bool("reordered", len(added) == 0 && len(removed) == 0),
+		}
+		if db.SchemaDrift != SCHEMA_DRIFT_WARN {
+			slog.Error("List columns changed since the last run", attrs...)
+			return fmt.Errorf("columns of list %s changed since the last run (added: %v, removed: %v), rerun with --schema-drift=%s to accept them", id, added, removed, SCHEMA_DRIFT_WARN)
+		}
+		slog.Warn("List columns changed since the last run", attrs...)
+	}
+	cmd, err := db.Conn.Exec(*db.Ctx, `
+	INSERT INTO list_schemas (list_id, columns, fingerprint, updated_at)
+	VALUES ($1, $2, $3, now())
+	ON CONFLICT (list_id)
+	DO UPDATE SET columns = EXCLUDED.columns, fingerprint = EXCLUDED.fingerprint, updated_at = EXCLUDED.updated_at;`,
+		id, columns, fingerprint)
+	if err != nil {
+		return fmt.Errorf("unable to store schema for list %s: %v, cmd: %s", id, err, cmd.String())
+	}
+	return nil
+}
+
+func columnChanges(before []string, after []string) ([]string, []string) {
+	added, removed := []string{}, []string{}
+	for _, col := range after {
+		if !slices.Contains(before, col) {
+			added = append(added, col)
+		}
+	}
+	for _, col := range before {
+		if !slices.Contains(after, col) {
+			removed = append(removed, col)
+		}
+	}
+	return added, removed
+}
@@ -0,0 +1,135 @@
+package database
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// first key of every advisory lock taken by bbextract, the second one is the hashed table name
+const LOCK_NAMESPACE int32 = 0x6262 // "bb"
+
+// how often a waiting job retries its locks
+const LOCK_POLL_INTERVAL = 5 * time.Second
+
+// the tables a job writes, locked exclusively, and the ones it only reads, locked shared
+type Locks struct {
+	Exclusive []string
+	Shared    []string
+}
+
+// table locks of every job, keyed by command name
+var JOB_LOCKS = map[string]Locks{
+	"transcripts": {Exclusive: []string{"transcripts"}, Shared: []string{"course_codes"}},
+	"comments":    {Exclusive: []string{"transcript_comments"}},
+	"parents":     {Exclusive: []string{"parents"}},
+	"attendance":  {Exclusive: []string{"attendance"}},
+	"enrollment":  {Exclusive: []string{"enrollment"}},
+	"gpa":         {Exclusive: []string{"gpa", "gpa_history"}, Shared: []string{"transcripts"}},
+}
+
+// the run holding a lock, Job and RunID are empty when the holder isn't a recorded run
+type LockHolder struct {
+	Table     string
+	Pid       int
+	RunID     string
+	Job       string
+	Host      string
+	StartedAt *time.Time
+}
+
+func (h LockHolder) String() string {
+	if h.RunID == "" {
+		return fmt.Sprintf("%s is locked by backend %d", h.Table, h.Pid)
+	}
+	return fmt.Sprintf("%s is locked by %s run %s on %s since %s", h.Table, h.Job, h.RunID, h.Host, h.StartedAt.Format(time.RFC3339))
+}
+
+/*
+Takes the session advisory locks of the tables in locks so concurrent jobs can't clean up and reload
+the same tables at once. They are held until the connection closes. Tables are locked in name order
+so two jobs can't deadlock. Unless LockWait is set a held lock fails right away, naming its holder.
+*/
+func (db *State) Lock(locks Locks) error {
+	tables := slices.Concat(locks.Exclusive, locks.Shared)
+	slices.Sort(tables)
+	for _, table := range slices.Compact(tables) {
+		shared := !slices.Contains(locks.Exclusive, table)
+		waiting := false
+		for {
+			ok, err := db.tryLock(table, shared)
+			if err != nil {
+				return fmt.Errorf("unable to lock %s: %v", table, err)
+			}
+			if ok {
+				break
+			}
+			holder, err := db.lockHolder(table)
+			if err != nil {
+				return fmt.Errorf("%s is locked, unable to find the holder: %v", table, err)
+			}
+			if holder.Pid == 0 {
+				// released in the meantime
+				continue
+			}
+			if !db.LockWait {
+				return fmt.Errorf("%s, rerun with --wait-for-lock to wait for it", holder)
+			}
+			if !waiting {
+				slog.Warn("Waiting for lock", slog.String("holder", holder.String()))
+				waiting = true
+			}
+			select {
+			case <-(*db.Ctx).Done():
+				return (*db.Ctx).Err()
+			case <-time.After(LOCK_POLL_INTERVAL):
+			}
+		}
+		if waiting {
+			slog.Info("Acquired lock", slog.String("table", table))
+		}
+	}
+	return nil
+}
+
+// takes the job's own locks from JOB_LOCKS
+func (db *State) LockJob() error {
+	return db.Lock(JOB_LOCKS[db.Job])
+}
+
+func (db *State) tryLock(table string, shared bool) (bool, error) {
+	fn := "pg_try_advisory_lock"
+	if shared {
+		fn = "pg_try_advisory_lock_shared"
+	}
+	var ok bool
+	err := db.Conn.QueryRow(*db.Ctx, fmt.Sprintf(`SELECT %s($1, hashtext($2))`, fn), LOCK_NAMESPACE, table).Scan(&ok)
+	return ok, err
+}
+
+// the oldest session holding the table's lock, with its run when it recorded one
+func (db *State) lockHolder(table string) (LockHolder, error) {
+	h := LockHolder{Table: table}
+	var runID, job, host *string
+	err := db.Conn.QueryRow(*db.Ctx, `
+		SELECT l.pid, r.run_id, r.job, r.host, r.started_at
+		FROM pg_locks l
+		LEFT JOIN runs r ON r.backend_pid = l.pid AND r.status = $3
+		WHERE l.locktype = 'advisory' AND l.granted
+		AND l.classid = $1::oid AND l.objid = hashtext($2)::oid AND l.objsubid = 2
+		ORDER BY r.started_at
+		LIMIT 1`, LOCK_NAMESPACE, table, RUN_RUNNING).Scan(&h.Pid, &runID, &job, &host, &h.StartedAt)
+	if err == pgx.ErrNoRows {
+		return h, nil
+	}
+	if runID != nil {
+		h.RunID, h.Job = *runID, *job
+	}
+	if host != nil {
+		h.Host = *host
+	}
+	return h, err
+}
@@ -0,0 +1,128 @@
+package database
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/BushSchoolIT/extractor/secrets"
+)
+
+const (
+	QUEUE_QUEUED    string = "queued"
+	QUEUE_RUNNING   string = "running"
+	QUEUE_SUCCEEDED string = "succeeded"
+	QUEUE_FAILED    string = "failed"
+	// wait before a failed job is tried again, doubling with every attempt
+	QUEUE_RETRY_BACKOFF = time.Minute
+)
+
+// a command waiting in or claimed from job_queue
+type QueuedJob struct {
+	ID          int64
+	Args        []string
+	Attempts    int
+	MaxAttempts int
+}
+
+// adds a command to job_queue, to be run by a worker once runAt has passed
+func (db *State) Enqueue(args []string, runAt time.Time, maxAttempts int) (int64, error) {
+	var id int64
+	err := db.Conn.QueryRow(*db.Ctx, `
+	INSERT INTO job_queue (args, run_at, max_attempts)
+	VALUES ($1, $2, $3)
+	RETURNING id`, args, runAt, maxAttempts).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("unable to enqueue %v: %v", args, err)
+	}
+	return id, nil
+}
+
+/*
+Claims the oldest job that is due, or whose lease expired because its worker stopped sending
+heartbeats, for worker to run until lease from now. SKIP LOCKED lets workers on other hosts claim
+different jobs at the same time without waiting on each other. Expired jobs that used up their
+attempts are marked failed instead, and never claimed should their lease expire in between.
+Returns nil when there's nothing to run.
+*/
+func (db *State) ClaimJob(worker string, lease time.Duration) (*QueuedJob, error) {
+	_, err := db.Conn.Exec(*db.Ctx, `
+	UPDATE job_queue
+	SET status = $1, finished_at = now(), error = 'lease of ' || worker || ' expired, attempts exhausted'
+	WHERE status = $2 AND lease_expires_at < now() AND attempts >= max_attempts`,
+		QUEUE_FAILED, QUEUE_RUNNING)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fail expired jobs: %v", err)
+	}
+	rows, err := db.Conn.Query(*db.Ctx, `
+	UPDATE job_queue
+	SET status = $1, worker = $2, attempts = attempts + 1, started_at = now(),
+		lease_expires_at = now() + make_interval(secs => $3), finished_at = NULL, error = NULL
+	WHERE id = (
+		SELECT id FROM job_queue
+		WHERE (status = $4 AND run_at <= now()) OR (status = $1 AND lease_expires_at < now() AND attempts < max_attempts)
+		ORDER BY run_at, id
+		LIMIT 1
+		FOR UPDATE SKIP LOCKED
+	)
+	RETURNING id, args, attempts, max_attempts`,
+		QUEUE_RUNNING, worker, lease.Seconds(), QUEUE_QUEUED)
+	if err != nil {
+		return nil, fmt.Errorf("unable to claim job: %v", err)
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	var job QueuedJob
+	err = rows.Scan(&job.ID, &job.Args, &job.Attempts, &job.MaxAttempts)
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// extends the lease on a claimed job, false if another worker took it over after the lease expired
+func (db *State) Heartbeat(id int64, worker string, lease time.Duration) (bool, error) {
+	cmd, err := db.Conn.Exec(*db.Ctx, `
+	UPDATE job_queue
+	SET lease_expires_at = now() + make_interval(secs => $3)
+	WHERE id = $1 AND worker = $2 AND status = $4`,
+		id, worker, lease.Seconds(), QUEUE_RUNNING)
+	if err != nil {
+		return false, err
+	}
+	return cmd.RowsAffected() == 1, nil
+}
+
+/*
+Records the result of a claimed job. A failed job with attempts left is queued again after a backoff,
+otherwise it's marked failed.
+*/
+func (db *State) FinishJob(job QueuedJob, worker string, runID string, runErr error) error {
+	status, runAt := QUEUE_SUCCEEDED, time.Now()
+	var message *string
+	if runErr != nil {
+		status = QUEUE_FAILED
+		s := secrets.Redact(runErr.Error())
+		message = &s
+		if job.Attempts < job.MaxAttempts {
+			status = QUEUE_QUEUED
+			runAt = runAt.Add(QUEUE_RETRY_BACKOFF << (job.Attempts - 1))
+		}
+	}
+	// NULL when the job failed before its run started
+	var run *string
+	if runID != "" {
+		run = &runID
+	}
+	_, err := db.Conn.Exec(*db.Ctx, `
+	UPDATE job_queue
+	SET status = $3, run_id = $4, error = $5, run_at = $6, lease_expires_at = NULL,
+		finished_at = CASE WHEN $3 = $7 THEN NULL ELSE now() END
+	WHERE id = $1 AND worker = $2`,
+		job.ID, worker, status, run, message, runAt, QUEUE_QUEUED)
+	if err != nil {
+		return fmt.Errorf("unable to record result of job %d: %v", job.ID, err)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+
+	"github.com/BushSchoolIT/extractor/blackbaud"
+	"github.com/jackc/pgx/v5"
+)
+
+// keeps every page a run fetches in public.raw_pages, blackbaud.RawPageSink
+type rawPageStore struct {
+	db *State
+}
+
+// replays the pages a run stored, blackbaud.PageSource
+type rawPageSource struct {
+	db    *State
+	runID string
+	job   string
+}
+
+// the job and run the original pages came from, plus what the run looked like
+type StoredRun struct {
+	RunID       string
+	Job         string
+	Incremental bool
+	Summary     map[string]any
+}
+
+func (db *State) RawPages() blackbaud.RawPageSink {
+	return &rawPageStore{db: db}
+}
+
+func (s *rawPageStore) SaveRawPage(id string, params url.Values, page int, body []byte) error {
+	s.db.connLock.Lock()
+	defer s.db.connLock.Unlock()
+	db := s.db
+	_, err := db.Conn.Exec(*db.Ctx, `
+	INSERT INTO raw_pages (run_id, job, list_id, page, params, body, fetched_at)
+	VALUES ($1, $2, $3, $4, $5, $6, now())
+	ON CONFLICT (run_id, job, list_id, page)
+	DO UPDATE SET params = EXCLUDED.params, body = EXCLUDED.body, fetched_at = EXCLUDED.fetched_at;`,
+		db.RunID, db.Job, id, page, params.Encode(), string(body))
+	return err
+}
+
+// a page source over the pages the given run of job stored
+func (db *State) ReplaySource(runID string, job string) blackbaud.PageSource {
+	return &rawPageSource{db: db, runID: runID, job: job}
+}
+
+func (s *rawPageSource) Page(id string, page int) ([]byte, error) {
+	s.db.connLock.Lock()
+	defer s.db.connLock.Unlock()
+	db := s.db
+	var body []byte
+	err := db.Conn.QueryRow(*db.Ctx, `
+		SELECT body
+		FROM raw_pages
+		WHERE run_id = $1 AND job = $2 AND list_id = $3 AND page = $4`,
+		s.runID, s.job, id, page).Scan(&body)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	return body, err
+}
+
+// the jobs of a run that stored raw pages, along with their audit information
+func (db *State) StoredRuns(runID string) ([]StoredRun, error) {
+	rows, err := db.Conn.Query(*db.Ctx, `
+		SELECT DISTINCT p.job, COALESCE(r.incremental, false), r.summary
+		FROM raw_pages p
+		LEFT JOIN runs r ON r.run_id = p.run_id AND r.job = p.job
+		WHERE p.run_id = $1
+		ORDER BY p.job`, runID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	runs := []StoredRun{}
+	for rows.Next() {
+		run := StoredRun{RunID: runID}
+		var summary []byte
+		err := rows.Scan(&run.Job, &run.Incremental, &summary)
+		if err != nil {
+			return nil, err
+		}
+		if summary != nil {
+			err = json.Unmarshal(summary, &run.Summary)
+			if err != nil {
+				return nil, fmt.Errorf("run %s has a corrupt summary: %v", runID, err)
+			}
+		}
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
@@ -0,0 +1,178 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/BushSchoolIT/extractor/blackbaud"
+	"github.com/BushSchoolIT/extractor/metrics"
+	"github.com/jackc/pgx/v5"
+)
+
+// a row that was not loaded, kept in public.rejected_rows so it can be inspected and fixed upstream
+type RejectedRow struct {
+	ID         int64
+	Job        string
+	RunID      string
+	Reason     string
+	Row        json.RawMessage
+	RejectedAt time.Time
+}
+
+func (db *State) reject(columns []string, row []any, reason string) {
+	raw := map[string]any{}
+	for i, col := range columns {
+		if i < len(row) {
+			raw[col] = row[i]
+		}
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(row))
+	}
+	metrics.RowsRejected.WithLabelValues(db.Job).Inc()
+	db.rejects = append(db.rejects, RejectedRow{
+		Job:    db.Job,
+		RunID:  db.RunID,
+		Reason: reason,
+		Row:    data,
+	})
+}
+
+/*
+Writes quarantined rows to public.rejected_rows. This runs outside of the job's transaction
+(call it once the transaction is done) so the rows are kept even when the load is rolled back.
+*/
+func (db *State) saveRejects() {
+	if len(db.rejects) == 0 {
+		return
+	}
+	saved := 0
+	for _, r := range db.rejects {
+		_, err := db.Conn.Exec(*db.Ctx, `
+		INSERT INTO rejected_rows (job, run_id, reason, row)
+		VALUES ($1, $2, $3, $4);`,
+			r.Job, r.RunID, r.Reason, string(r.Row))
+		if err != nil {
+			slog.Error("Unable to quarantine rejected row", slog.String("reason", r.Reason), slog.Any("error", err))
+			continue
+		}
+		saved++
+	}
+	slog.Warn("Quarantined rejected rows", slog.Int("count", saved), slog.String("job", db.Job), slog.String("run", db.RunID))
+	db.rejects = nil
+}
+
+/*
+Drops rows with a null primary key column, they can never be upserted. Dropped rows are quarantined,
+they don't count against the error budget because blackbaud lists routinely include a few of them.
+*/
+func (db *State) removeNull(keys map[string]bool, t blackbaud.UnorderedTable) blackbaud.UnorderedTable {
+	rows := make([][]any, 0, len(t.Rows))
+	for _, row := range t.Rows {
+		nullKey := ""
+		for j, col := range row {
+			if keys[t.Columns[j]] && col == nil {
+				nullKey = t.Columns[j]
+				break
+			}
+		}
+		if nullKey != "" {
+			db.reject(t.Columns, row, fmt.Sprintf("null primary key column: %s", nullKey))
+			continue
+		}
+		rows = append(rows, row)
+	}
+	if dropped := len(t.Rows) - len(rows); dropped > 0 {
+		slog.Warn("Removed rows with null primary keys", slog.Int("count", dropped))
+	}
+	return blackbaud.UnorderedTable{Columns: t.Columns, Rows: rows, Partial: t.Partial}
+}
+
+// starts a load's transaction, rows it upserts are only counted in metrics.RowsUpserted once commit succeeds
+func (db *State) begin() (pgx.Tx, error) {
+	db.upserted = map[string]int{}
+	return db.Conn.BeginTx(*db.Ctx, pgx.TxOptions{})
+}
+
+// commits a transaction started with begin and counts the rows it upserted
+func (db *State) commit(tx pgx.Tx) error {
+	err := tx.Commit(*db.Ctx)
+	if err == nil {
+		for table, count := range db.upserted {
+			metrics.RowsUpserted.WithLabelValues(table).Add(float64(count))
+		}
+	}
+	db.upserted = nil
+	return err
+}
+
+/*
+Inserts every row with the given query. Without an error budget the first failure aborts the load.
+With one, each row runs in its own savepoint so a bad row is quarantined and the rest still load,
+until more than ErrorBudget rows have failed over the whole run.
+*/
+func (db *State) insertRows(tx pgx.Tx, table string, t blackbaud.UnorderedTable, insert string) error {
+	for _, row := range t.Rows {
+		if db.ErrorBudget <= 0 {
+			cmd, err := tx.Exec(*db.Ctx, insert, row...)
+			if err != nil {
+				db.reject(t.Columns, row, err.Error())
+				return fmt.Errorf("db insert failed: %v, cmd: %s, query: %s", err, cmd.String(), insert)
+			}
+			db.upserted[table]++
+			continue
+		}
+		savepoint, err := tx.Begin(*db.Ctx)
+		if err != nil {
+			return err
+		}
+		cmd, err := savepoint.Exec(*db.Ctx, insert, row...)
+		if err == nil {
+			err = savepoint.Commit(*db.Ctx)
+			if err != nil {
+				return err
+			}
+			db.upserted[table]++
+			continue
+		}
+		rollbackErr := savepoint.Rollback(*db.Ctx)
+		if rollbackErr != nil {
+			return rollbackErr
+		}
+		db.reject(t.Columns, row, err.Error())
+		db.failedRows++
+		if db.failedRows > db.ErrorBudget {
+			return fmt.Errorf("error budget of %d rows exceeded, last error: %v, cmd: %s, query: %s", db.ErrorBudget, err, cmd.String(), insert)
+		}
+		slog.Warn("Quarantined row that failed to insert", slog.Any("error", err), slog.Int("failed", db.failedRows), slog.Int("budget", db.ErrorBudget))
+	}
+	return nil
+}
+
+// lists quarantined rows, newest first, optionally limited to a job and/or a run
+func (db *State) RejectedRows(job string, runID string, limit int) ([]RejectedRow, error) {
+	rows, err := db.Conn.Query(*db.Ctx, `
+		SELECT id, job, run_id, reason, row, rejected_at
+		FROM rejected_rows
+		WHERE ($1::text = '' OR job = $1)
+			AND ($2::text = '' OR run_id = $2)
+		ORDER BY id DESC
+		LIMIT $3`, job, runID, limit)
+	if err != nil {
+		return nil, err
+	}
+	rejected := []RejectedRow{}
+	for rows.Next() {
+		r := RejectedRow{}
+		err := rows.Scan(&r.ID, &r.Job, &r.RunID, &r.Reason, &r.Row, &r.RejectedAt)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		rejected = append(rejected, r)
+	}
+	return rejected, rows.Err()
+}
@@ -0,0 +1,196 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/BushSchoolIT/extractor/metrics"
+	"github.com/BushSchoolIT/extractor/secrets"
+)
+
+const (
+	RUN_RUNNING   string = "running"
+	RUN_SUCCEEDED string = "succeeded"
+	RUN_FAILED    string = "failed"
+)
+
+/*
+Records the start of a job in public.runs, the audit trail every ETL command leaves behind, then takes
+the job's table locks. The backend PID is recorded so other runs can tell who holds a lock.
+FinishRun must be called with the job's result once it is done.
+*/
+func (db *State) StartRun() error {
+	host, _ := os.Hostname()
+	cmd, err := db.Conn.Exec(*db.Ctx, `
+	INSERT INTO runs (run_id, job, status, host, pid, backend_pid, schedule, attempt)
+	VALUES ($1, $2, $3, $4, $5, pg_backend_pid(), NULLIF($6, ''), NULLIF($7, 0));`,
+		db.RunID, db.Job, RUN_RUNNING, host, os.Getpid(), db.Schedule, db.Attempt)
+	if err != nil {
+		return fmt.Errorf("unable to record run start: %v, cmd: %s", err, cmd.String())
+	}
+	db.startedAt = time.Now()
+	err = db.LockJob()
+	if err != nil {
+		db.FinishRun(err)
+		return err
+	}
+	return nil
+}
+
+// adds an entry to the run's summary, stored as JSON with the run once it finishes
+func (db *State) Summarize(key string, value any) {
+	if db.summary == nil {
+		db.summary = map[string]any{}
+	}
+	db.summary[key] = value
+}
+
+// a finished run as FinishRun recorded it, handed to OnFinish
+type RunResult struct {
+	RunID     string
+	Job       string
+	Status    string
+	StartedAt time.Time
+	Duration  time.Duration
+	RowsIn    *int
+	Error     error
+	Summary   map[string]any
+}
+
+// marks the run as succeeded or failed along with the number of rows it received, then calls OnFinish
+func (db *State) FinishRun(runErr error) {
+	status := RUN_SUCCEEDED
+	var message *string
+	if runErr != nil {
+		status = RUN_FAILED
+		s := secrets.Redact(runErr.Error())
+		message = &s
+	}
+	// recorded even when the run was cancelled, e.g. because a worker lost its lease
+	_, err := db.Conn.Exec(context.WithoutCancel(*db.Ctx), `
+	UPDATE runs
+	SET status = $2, finished_at = now(), rows_in = $3, error = $4, summary = $6, incremental = $7
+	WHERE run_id = $1 AND job = $5;`,
+		db.RunID, status, db.rowsIn, message, db.Job, db.summary, db.Incremental)
+	if err != nil {
+		slog.Error("Unable to record run result", slog.String("run", db.RunID), slog.Any("error", err))
+	}
+	metrics.Runs.WithLabelValues(db.Job, status).Inc()
+	metrics.LastRun.WithLabelValues(db.Job, status).SetToCurrentTime()
+	metrics.RunDuration.WithLabelValues(db.Job).Set(time.Since(db.startedAt).Seconds())
+	if db.OnFinish != nil {
+		db.OnFinish(RunResult{
+			RunID:     db.RunID,
+			Job:       db.Job,
+			Status:    status,
+			StartedAt: db.startedAt,
+			Duration:  time.Since(db.startedAt),
+			RowsIn:    db.rowsIn,
+			Error:     secrets.RedactError(runErr),
+			Summary:   db.summary,
+		})
+	}
+}
+
+// when a run of the schedule last started, false if it never ran
+func (db *State) LastScheduledRun(schedule string) (time.Time, bool, error) {
+	var last *time.Time
+	err := db.Conn.QueryRow(*db.Ctx, `SELECT max(started_at) FROM runs WHERE schedule = $1`, schedule).Scan(&last)
+	if err != nil || last == nil {
+		return time.Time{}, false, err
+	}
+	return *last, true, nil
+}
+
+// the number of incoming rows of the job's last successful full run, nil if it never succeeded
+func (db *State) lastSuccessfulRows(q querier) (*int, error) {
+	rows, err := q.Query(*db.Ctx, `
+		SELECT rows_in
+		FROM runs
+		WHERE job = $1 AND status = $2 AND rows_in IS NOT NULL AND NOT incremental
+		ORDER BY finished_at DESC
+		LIMIT 1`, db.Job, RUN_SUCCEEDED)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	var count int
+	err = rows.Scan(&count)
+	return &count, err
+}
+
+// the part of a table a load replaces, e.g. the years pulled, with the number of incoming rows that fall in it
+type rowScope struct {
+	table    string
+	where    string
+	args     []any
+	incoming int
+}
+
+/*
+Guards destructive loads against a truncated or empty source. The incoming row count is compared with
+the job's last successful run and, when scope is set, the incoming rows within it with the rows of the
+table within it. Loads that upsert into a table keeping history pass no scope since the table as a whole
+says nothing about what should come in. A shrink of more than MaxShrinkPercent aborts the load unless
+Force is set. A MaxShrinkPercent of 0 disables the guard, as do incremental runs since they only receive
+the changed rows.
+*/
+func (db *State) checkRowCount(q querier, incoming int, scope *rowScope) error {
+	db.rowsIn = &incoming
+	if db.MaxShrinkPercent <= 0 || db.Incremental {
+		return nil
+	}
+	type baseline struct{ expected, incoming int }
+	baselines := map[string]baseline{}
+	last, err := db.lastSuccessfulRows(q)
+	if err != nil {
+		return fmt.Errorf("unable to get last successful run: %v", err)
+	}
+	if last != nil {
+		baselines["last successful run"] = baseline{*last, incoming}
+	}
+	if scope != nil {
+		query, name := fmt.Sprintf(`SELECT COUNT(*) FROM %s`, scope.table), "table "+scope.table
+		if scope.where != "" {
+			query += " WHERE " + scope.where
+			name = fmt.Sprintf("rows of %s where %s", scope.table, scope.where)
+		}
+		var current int
+		rows, err := q.Query(*db.Ctx, query, scope.args...)
+		if err != nil {
+			return fmt.Errorf("unable to count rows in %s: %v", scope.table, err)
+		}
+		if rows.Next() {
+			err = rows.Scan(&current)
+		}
+		rows.Close()
+		if err == nil {
+			err = rows.Err()
+		}
+		if err != nil {
+			return err
+		}
+		baselines[name] = baseline{current, scope.incoming}
+	}
+	for name, b := range baselines {
+		if b.expected == 0 {
+			continue
+		}
+		shrink := float64(b.expected-b.incoming) / float64(b.expected) * 100
+		if shrink <= db.MaxShrinkPercent {
+			continue
+		}
+		if db.Force {
+			slog.Warn("Row count dropped past the safety limit, continuing because of --force", slog.String("baseline", name), slog.Int("expected", b.expected), slog.Int("incoming", b.incoming), slog.Float64("shrink_percent", shrink))
+			continue
+		}
+		return fmt.Errorf("incoming rows (%d) are %.1f%% fewer than the %s (%d), more than the %.1f%% allowed, rerun with --force if this is expected", b.incoming, shrink, name, b.expected, db.MaxShrinkPercent)
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package database
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// where staged loads write, tables only exist here between Stage and SwapStaged
+	STAGING_SCHEMA string = "staging"
+	// the generation replaced by the last swap of each table, kept for RollbackSwap
+	PREVIOUS_SCHEMA string = "previous"
+)
+
+/*
+Copies the tables the job writes into the staging schema and points the connection at them, so the job's
+load, transforms and validations run against the copies while readers keep seeing the untouched tables in
+public. Tables keep their columns, defaults, constraints, indexes and grants. SwapStaged publishes them,
+Unstage throws them away.
+*/
+func (db *State) Stage() error {
+	tables := JOB_LOCKS[db.Job].Exclusive
+	if len(tables) == 0 {
+		return fmt.Errorf("job %s has no tables to stage", db.Job)
+	}
+	tx, err := db.Conn.Begin(*db.Ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(*db.Ctx)
+	_, err = tx.Exec(*db.Ctx, fmt.Sprintf(`CREATE SCHEMA IF NOT EXISTS %s; CREATE SCHEMA IF NOT EXISTS %s;`, STAGING_SCHEMA, PREVIOUS_SCHEMA))
+	if err != nil {
+		return fmt.Errorf("unable to create schemas: %v", err)
+	}
+	for _, table := range tables {
+		staged := pgx.Identifier{STAGING_SCHEMA, table}.Sanitize()
+		public := pgx.Identifier{"public", table}.Sanitize()
+		_, err = tx.Exec(*db.Ctx, fmt.Sprintf(`
+		DROP TABLE IF EXISTS %[1]s;
+		CREATE TABLE %[1]s (LIKE %[2]s INCLUDING ALL);
+		INSERT INTO %[1]s SELECT * FROM %[2]s;`, staged, public))
+		if err != nil {
+			return fmt.Errorf("unable to stage %s: %v", table, err)
+		}
+		err = copyGrants(db, tx, table)
+		if err != nil {
+			return fmt.Errorf("unable to copy grants of %s: %v", table, err)
+		}
+	}
+	err = tx.Commit(*db.Ctx)
+	if err != nil {
+		return err
+	}
+	// everything else the job touches isn't staged and still resolves to public
+	_, err = db.Conn.Exec(*db.Ctx, fmt.Sprintf(`SET search_path TO %s, public`, STAGING_SCHEMA))
+	if err != nil {
+		return fmt.Errorf("unable to switch to staging: %v", err)
+	}
+	db.Staged = true
+	slog.Info("Staged tables", slog.Any("tables", tables))
+	return nil
+}
+
+// the grants of public.table, readers like Power BI would lose access after a swap without them
+func copyGrants(db *State, tx pgx.Tx, table string) error {
+	rows, err := tx.Query(*db.Ctx, `
+		SELECT grantee, privilege_type
+		FROM information_schema.role_table_grants
+		WHERE table_schema = 'public' AND table_name = $1 AND grantee <> current_user`, table)
+	if err != nil {
+		return err
+	}
+	grants := [][2]string{}
+	for rows.Next() {
+		var grantee, privilege string
+		err = rows.Scan(&grantee, &privilege)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		grants = append(grants, [2]string{grantee, privilege})
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+	for _, g := range grants {
+		grantee := pgx.Identifier{g[0]}.Sanitize()
+		if g[0] == "PUBLIC" {
+			grantee = "PUBLIC"
+		}
+		// privilege_type comes from postgres itself so it's safe to splice in
+		_, err = tx.Exec(*db.Ctx, fmt.Sprintf(`GRANT %s ON %s TO %s`, g[1], pgx.Identifier{STAGING_SCHEMA, table}.Sanitize(), grantee))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Publishes the staged tables in one short transaction: each public table moves to the previous schema,
+replacing the generation there, and its staged copy moves into public. Readers only wait for the renames.
+Views on the tables follow them by OID, so they keep pointing at the previous generation and must be
+recreated after a swap.
+*/
+func (db *State) SwapStaged() error {
+	if !db.Staged {
+		return nil
+	}
+	tables := JOB_LOCKS[db.Job].Exclusive
+	err := db.resetSearchPath()
+	if err != nil {
+		return err
+	}
+	err = db.moveTables(tables, [][2]string{
+		{PREVIOUS_SCHEMA, ""},
+		{"public", PREVIOUS_SCHEMA},
+		{STAGING_SCHEMA, "public"},
+	})
+	if err != nil {
+		return fmt.Errorf("unable to swap staged tables: %v", err)
+	}
+	db.Staged = false
+	slog.Info("Swapped staged tables into public", slog.Any("tables", tables))
+	return nil
+}
+
+// drops the staged copies of a load that failed, public was never touched
+func (db *State) Unstage() {
+	if !db.Staged {
+		return
+	}
+	err := db.resetSearchPath()
+	if err != nil {
+		slog.Error("Unable to leave staging", slog.Any("error", err))
+	}
+	for _, table := range JOB_LOCKS[db.Job].Exclusive {
+		_, err = db.Conn.Exec(*db.Ctx, fmt.Sprintf(`DROP TABLE IF EXISTS %s`, pgx.Identifier{STAGING_SCHEMA, table}.Sanitize()))
+		if err != nil {
+			slog.Error("Unable to drop staged table", slog.String("table", table), slog.Any("error", err))
+		}
+	}
+	db.Staged = false
+}
+
+func (db *State) resetSearchPath() error {
+	_, err := db.Conn.Exec(*db.Ctx, `RESET search_path`)
+	return err
+}
+
+// swaps the job's tables back with the generation the last swap replaced, running it again undoes it
+func (db *State) RollbackSwap() error {
+	tables := JOB_LOCKS[db.Job].Exclusive
+	if len(tables) == 0 {
+		return fmt.Errorf("job %s has no staged tables", db.Job)
+	}
+	for _, table := range tables {
+		var exists bool
+		err := db.Conn.QueryRow(*db.Ctx, `SELECT to_regclass($1) IS NOT NULL`, pgx.Identifier{PREVIOUS_SCHEMA, table}.Sanitize()).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("%s has no previous generation to roll back to", table)
+		}
+	}
+	// staging is only used to park public while the previous generation moves in
+	return db.moveTables(tables, [][2]string{
+		{STAGING_SCHEMA, ""},
+		{"public", STAGING_SCHEMA},
+		{PREVIOUS_SCHEMA, "public"},
+		{STAGING_SCHEMA, PREVIOUS_SCHEMA},
+	})
+}
+
+// applies each move (from schema, to schema, "" drops the table) to every table in one transaction
+func (db *State) moveTables(tables []string, moves [][2]string) error {
+	tx, err := db.Conn.Begin(*db.Ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(*db.Ctx)
+	for _, table := range tables {
+		for _, move := range moves {
+			from := pgx.Identifier{move[0], table}.Sanitize()
+			query := fmt.Sprintf(`DROP TABLE IF EXISTS %s`, from)
+			if move[1] != "" {
+				query = fmt.Sprintf(`ALTER TABLE %s SET SCHEMA %s`, from, pgx.Identifier{move[1]}.Sanitize())
+			}
+			_, err = tx.Exec(*db.Ctx, query)
+			if err != nil {
+				return fmt.Errorf("%s: %v", table, err)
+			}
+		}
+	}
+	return tx.Commit(*db.Ctx)
+}
@@ -0,0 +1,191 @@
+package database
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/BushSchoolIT/extractor/blackbaud"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// rows missing from the source are deleted
+	SYNC_DELETE string = "delete"
+	// rows missing from the source get deleted_at set, and cleared again if they come back, the table needs the column
+	SYNC_SOFT_DELETE string = "soft-delete"
+	// rows missing from the source are only counted and logged
+	SYNC_REPORT string = "report"
+)
+
+// number of rows missing from the source that are logged
+const SYNC_SAMPLES int = 5
+
+/*
+How a job propagates rows deleted in blackbaud, upserts alone never remove anything. Only the slice of
+the table the source covered is synchronized: transcripts within the years pulled and, with ScopeColumn,
+rows whose value in that column was pulled (attendance needs it since it only pulls one day).
+*/
+type SyncConfig struct {
+	Mode        string `json:"mode"`
+	ScopeColumn string `json:"scope_column"`
+}
+
+func (c SyncConfig) Validate() error {
+	switch c.Mode {
+	case "", SYNC_DELETE, SYNC_SOFT_DELETE, SYNC_REPORT:
+		return nil
+	}
+	return fmt.Errorf("sync mode must be %s, %s or %s, got %q", SYNC_DELETE, SYNC_SOFT_DELETE, SYNC_REPORT, c.Mode)
+}
+
+/*
+Removes, soft-deletes or reports the rows of table within scope whose keys aren't in any of the incoming
+tables. The keys are loaded into a temporary table and a MERGE of the scoped rows against it applies the
+mode, emulating WHEN NOT MATCHED BY SOURCE which postgres 15 lacks. scope is a condition on the table
+aliased as x with its own arguments, "" covers the whole table. Incremental runs without a scope are
+skipped since they only pulled the changed rows.
+*/
+func (db *State) syncDeletions(tx pgx.Tx, table string, keys []string, incoming []blackbaud.UnorderedTable, scope string, args ...any) error {
+	mode, scopeColumn := db.Sync.Mode, db.Sync.ScopeColumn
+	if mode == "" {
+		return nil
+	}
+	if db.Incremental && scope == "" && scopeColumn == "" {
+		slog.Warn("Skipping deletion sync, an incremental run only pulled the changed rows", slog.String("table", table))
+		return nil
+	}
+	columns := slices.Clone(keys)
+	if scopeColumn != "" && !slices.Contains(columns, scopeColumn) {
+		columns = append(columns, scopeColumn)
+	}
+	_, err := tx.Exec(*db.Ctx, fmt.Sprintf(`
+	DROP TABLE IF EXISTS pg_temp.sync_keys;
+	CREATE TEMP TABLE sync_keys ON COMMIT DROP AS SELECT %s FROM %s WITH NO DATA;`,
+		strings.Join(columns, ","), table))
+	if err != nil {
+		return fmt.Errorf("unable to create sync keys table: %v", err)
+	}
+	insert := fmt.Sprintf(`INSERT INTO sync_keys (%s) VALUES (%s)`, strings.Join(columns, ","), placeHolders(len(columns)))
+	batch := &pgx.Batch{}
+	for _, t := range incoming {
+		indexes := []int{}
+		for _, col := range columns {
+			i := slices.Index(t.Columns, col)
+			if i == -1 {
+				return fmt.Errorf("unable to sync %s, incoming rows have no %s column", table, col)
+			}
+			indexes = append(indexes, i)
+		}
+		for _, row := range t.Rows {
+			values := []any{}
+			for _, i := range indexes {
+				values = append(values, row[i])
+			}
+			batch.Queue(insert, values...)
+		}
+	}
+	err = tx.SendBatch(*db.Ctx, batch).Close()
+	if err != nil {
+		return fmt.Errorf("unable to load sync keys: %v", err)
+	}
+
+	conditions := []string{"TRUE"}
+	if scope != "" {
+		conditions = append(conditions, scope)
+	}
+	if scopeColumn != "" {
+		conditions = append(conditions, fmt.Sprintf(`x.%[1]s IN (SELECT %[1]s FROM sync_keys)`, scopeColumn))
+	}
+	where := strings.Join(conditions, " AND ")
+	present := fmt.Sprintf(`EXISTS (SELECT 1 FROM sync_keys k WHERE %s)`, joinKeys(keys, "k", "x"))
+	missing, err := db.missingRows(tx, table, keys, where, present, args)
+	if err != nil {
+		return fmt.Errorf("unable to count rows missing from the source: %v", err)
+	}
+	db.Summarize("deletions", map[string]any{"table": table, "mode": mode, "rows": missing})
+	if mode == SYNC_REPORT {
+		return nil
+	}
+
+	actions := `WHEN MATCHED AND NOT s.present THEN DELETE`
+	if mode == SYNC_SOFT_DELETE {
+		// the column is part of the schema, a data job has no business altering tables readers are using
+		var exists bool
+		err = tx.QueryRow(*db.Ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM pg_attribute
+			WHERE attrelid = to_regclass($1) AND attname = 'deleted_at' AND NOT attisdropped
+		)`, table).Scan(&exists)
+		if err != nil {
+			return fmt.Errorf("unable to check %s for deleted_at: %v", table, err)
+		}
+		if !exists {
+			return fmt.Errorf("%s has no deleted_at column for %s, add it as in schema.sql", table, SYNC_SOFT_DELETE)
+		}
+		actions = `
+		WHEN MATCHED AND NOT s.present AND t.deleted_at IS NULL THEN UPDATE SET deleted_at = now()
+		WHEN MATCHED AND s.present AND t.deleted_at IS NOT NULL THEN UPDATE SET deleted_at = NULL`
+	}
+	cmd, err := tx.Exec(*db.Ctx, fmt.Sprintf(`
+	MERGE INTO %[1]s t
+	USING (
+		SELECT %[2]s, %[3]s AS present
+		FROM %[1]s x
+		WHERE %[4]s
+	) s
+	ON %[5]s
+	%[6]s;`,
+		table, prefixColumns(keys, "x"), present, where, joinKeys(keys, "t", "s"), actions), args...)
+	if err != nil {
+		return fmt.Errorf("unable to sync deletions of %s: %v, cmd: %s", table, err, cmd.String())
+	}
+	slog.Info("Synchronized deletions", slog.String("table", table), slog.String("mode", mode), slog.Int64("rows", cmd.RowsAffected()))
+	return nil
+}
+
+// counts the scoped rows that aren't in the source and logs a few of their keys
+func (db *State) missingRows(tx pgx.Tx, table string, keys []string, where string, present string, args []any) (int, error) {
+	var count int
+	err := tx.QueryRow(*db.Ctx, fmt.Sprintf(`SELECT COUNT(*) FROM %s x WHERE %s AND NOT %s`, table, where, present), args...).Scan(&count)
+	if err != nil || count == 0 {
+		return count, err
+	}
+	slog.Warn("Rows missing from the source", slog.String("table", table), slog.Int("rows", count), slog.String("mode", db.Sync.Mode))
+	rows, err := tx.Query(*db.Ctx, fmt.Sprintf(`SELECT %s FROM %s x WHERE %s AND NOT %s LIMIT %d`,
+		prefixColumns(keys, "x"), table, where, present, SYNC_SAMPLES), args...)
+	if err != nil {
+		return count, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		values, err := rows.Values()
+		if err != nil {
+			return count, err
+		}
+		pairs := []string{}
+		for i, value := range values {
+			pairs = append(pairs, fmt.Sprintf("%s=%s", keys[i], formatValue(value)))
+		}
+		slog.Warn("Missing row", slog.String("table", table), slog.String("keys", strings.Join(pairs, " ")))
+	}
+	return count, rows.Err()
+}
+
+// a.key1 = b.key1 AND a.key2 = b.key2 ...
+func joinKeys(keys []string, a string, b string) string {
+	conditions := []string{}
+	for _, key := range keys {
+		conditions = append(conditions, fmt.Sprintf("%s.%s = %s.%s", a, key, b, key))
+	}
+	return strings.Join(conditions, " AND ")
+}
+
+func prefixColumns(columns []string, alias string) string {
+	prefixed := []string{}
+	for _, col := range columns {
+		prefixed = append(prefixed, alias+"."+col)
+	}
+	return strings.Join(prefixed, ",")
+}
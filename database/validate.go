@@ -0,0 +1,93 @@
+package database
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"slices"
+	"time"
+)
+
+/*
+An invariant over the loaded tables written as a SQL query that selects the offending rows,
+the check passes when the query returns nothing. Jobs limits which ETL commands run the check
+after committing, when it is empty every command runs it.
+*/
+type Validation struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Query       string   `json:"query"`
+	Jobs        []string `json:"jobs"`
+}
+
+type ValidationResult struct {
+	Validation Validation
+	// number of offending rows
+	Failures int
+	Columns  []string
+	// up to the requested number of offending rows, formatted for printing
+	Samples [][]string
+}
+
+func (r ValidationResult) Passed() bool {
+	return r.Failures == 0
+}
+
+func (v Validation) AppliesTo(job string) bool {
+	return len(v.Jobs) == 0 || slices.Contains(v.Jobs, job)
+}
+
+// runs every validation and collects its result, an error is only returned when a query can't run
+func (db *State) Validate(validations []Validation, samples int) ([]ValidationResult, error) {
+	results := []ValidationResult{}
+	for _, v := range validations {
+		result := ValidationResult{Validation: v}
+		err := db.Conn.QueryRow(*db.Ctx, fmt.Sprintf(`SELECT COUNT(*) FROM (%s) AS offending`, v.Query)).Scan(&result.Failures)
+		if err != nil {
+			return results, fmt.Errorf("validation %s failed to run: %v", v.Name, err)
+		}
+		if result.Failures > 0 && samples > 0 {
+			rows, err := db.Conn.Query(*db.Ctx, fmt.Sprintf(`SELECT * FROM (%s) AS offending LIMIT %d`, v.Query, samples))
+			if err != nil {
+				return results, fmt.Errorf("validation %s failed to sample rows: %v", v.Name, err)
+			}
+			for _, field := range rows.FieldDescriptions() {
+				result.Columns = append(result.Columns, field.Name)
+			}
+			for rows.Next() {
+				values, err := rows.Values()
+				if err != nil {
+					rows.Close()
+					return results, err
+				}
+				sample := []string{}
+				for _, value := range values {
+					sample = append(sample, formatValue(value))
+				}
+				result.Samples = append(result.Samples, sample)
+			}
+			if err := rows.Err(); err != nil {
+				return results, err
+			}
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// a value read with rows.Values() as psql would print it, pgtype values like numerics go through their driver.Value
+func formatValue(value any) string {
+	if v, ok := value.(driver.Valuer); ok {
+		if plain, err := v.Value(); err == nil {
+			value = plain
+		}
+	}
+	switch v := value.(type) {
+	case nil:
+		return "NULL"
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.Format(time.RFC3339)
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,49 @@
+package database
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// how far an incremental job got, lists are filtered from Mark on until the next full refresh
+type Watermark struct {
+	Job             string
+	Mark            string
+	LastFullRefresh time.Time
+	UpdatedAt       time.Time
+}
+
+// the job's watermark, nil when it has never run incrementally
+func (db *State) Watermark(job string) (*Watermark, error) {
+	w := Watermark{Job: job}
+	err := db.Conn.QueryRow(*db.Ctx, `
+		SELECT mark, last_full_refresh, updated_at
+		FROM watermarks
+		WHERE job = $1`, job).Scan(&w.Mark, &w.LastFullRefresh, &w.UpdatedAt)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &w, nil
+}
+
+// stores the job's new mark once its load committed, a full refresh also resets the refresh clock
+func (db *State) SaveWatermark(job string, mark string, fullRefresh bool) error {
+	cmd, err := db.Conn.Exec(*db.Ctx, `
+	INSERT INTO watermarks (job, mark, last_full_refresh, updated_at)
+	VALUES ($1, $2, now(), now())
+	ON CONFLICT (job)
+	DO UPDATE SET
+		mark = EXCLUDED.mark,
+		last_full_refresh = CASE WHEN $3 THEN EXCLUDED.last_full_refresh ELSE watermarks.last_full_refresh END,
+		updated_at = EXCLUDED.updated_at;`,
+		job, mark, fullRefresh)
+	if err != nil {
+		return fmt.Errorf("unable to save watermark for %s: %v, cmd: %s", job, err, cmd.String())
+	}
+	return nil
+}
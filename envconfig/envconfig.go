@@ -0,0 +1,88 @@
+package envconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+/*
+Overrides fields of the struct v points to with environment variables named after their JSON keys,
+e.g. with prefix BBEXTRACT, postgres.password is BBEXTRACT_POSTGRES_PASSWORD. Strings are taken as is,
+lists of strings may be comma separated, anything else is parsed as JSON, so whole objects and lists can
+be replaced too. Returns the names of the variables that were applied.
+*/
+func Apply(prefix string, v any) ([]string, error) {
+	applied := []string{}
+	err := applyStruct(prefix, reflect.ValueOf(v).Elem(), &applied)
+	return applied, err
+}
+
+// whether any variable is named under prefix, e.g. one for a field of a nested object
+func hasPrefix(prefix string) bool {
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, prefix+"_") {
+			return true
+		}
+	}
+	return false
+}
+
+func applyStruct(prefix string, v reflect.Value, applied *[]string) error {
+	t := v.Type()
+	for i := range t.NumField() {
+		f := t.Field(i)
+		key := strings.Split(f.Tag.Get("json"), ",")[0]
+		if !f.IsExported() || key == "" || key == "-" {
+			continue
+		}
+		name := prefix + "_" + strings.ToUpper(key)
+		field := v.Field(i)
+		if raw, ok := os.LookupEnv(name); ok {
+			err := set(field, raw)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			*applied = append(*applied, name)
+			continue
+		}
+		switch {
+		case field.Kind() == reflect.Struct:
+			err := applyStruct(name, field, applied)
+			if err != nil {
+				return err
+			}
+		case field.Kind() == reflect.Pointer && field.Type().Elem().Kind() == reflect.Struct && hasPrefix(name):
+			if field.IsNil() {
+				field.Set(reflect.New(field.Type().Elem()))
+			}
+			err := applyStruct(name, field.Elem(), applied)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func set(v reflect.Value, raw string) error {
+	switch {
+	case v.Kind() == reflect.String:
+		v.SetString(raw)
+		return nil
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(strings.TrimSpace(raw), "["):
+		items := reflect.MakeSlice(v.Type(), 0, 0)
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = reflect.Append(items, reflect.ValueOf(item).Convert(v.Type().Elem()))
+			}
+		}
+		v.Set(items)
+		return nil
+	}
+	// replace rather than merge into maps and objects
+	v.Set(reflect.Zero(v.Type()))
+	return json.Unmarshal([]byte(raw), v.Addr().Interface())
+}
@@ -0,0 +1,32 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/BushSchoolIT/extractor/secrets"
+)
+
+const (
+	FORMAT_TEXT string = "text"
+	FORMAT_JSON string = "json"
+)
+
+// a slog handler writing records to w as text or JSON at or above level (debug, info, warn or error), with secrets redacted
+func NewHandler(w io.Writer, format string, level string) (slog.Handler, error) {
+	var l slog.Level
+	err := l.UnmarshalText([]byte(level))
+	if err != nil {
+		return nil, fmt.Errorf("log level must be debug, info, warn or error, got %q", level)
+	}
+	opts := &slog.HandlerOptions{Level: l}
+	switch strings.ToLower(format) {
+	case FORMAT_TEXT:
+		return secrets.Handler(slog.NewTextHandler(w, opts)), nil
+	case FORMAT_JSON:
+		return secrets.Handler(slog.NewJSONHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("log format must be %s or %s, got %q", FORMAT_TEXT, FORMAT_JSON, format)
+}
@@ -0,0 +1,191 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotates the log file when the day changes, the other rotation is by size, e.g. "100MB"
+const ROTATE_DAILY string = "daily"
+
+// the suffixes rotate appends, the rotation time or day and a counter when the name was taken
+var rotatedSuffix = regexp.MustCompile(`^(\d{8}T\d{6}|\d{4}-\d{2}-\d{2})(\.\d+)?$`)
+
+var sizeUnits = map[string]int64{
+	"KB": 1 << 10,
+	"MB": 1 << 20,
+	"GB": 1 << 30,
+}
+
+/*
+A log file that rotates itself, either daily or once it reaches a size. Rotated files are renamed with the
+time they were rotated (the day for daily rotation) appended, and only the newest keep of them are kept.
+*/
+type RotatingFile struct {
+	path    string
+	maxSize int64
+	daily   bool
+	keep    int
+
+	lock sync.Mutex
+	f    *os.File
+	size int64
+	day  string
+}
+
+// opens or creates path for appending, rotate is "" for never, ROTATE_DAILY or a size like "50MB"
+func OpenRotating(path string, rotate string, keep int) (*RotatingFile, error) {
+	r := &RotatingFile{path: path, keep: keep}
+	switch {
+	case rotate == "":
+	case rotate == ROTATE_DAILY:
+		r.daily = true
+	default:
+		size, err := parseSize(rotate)
+		if err != nil {
+			return nil, err
+		}
+		r.maxSize = size
+	}
+	err := r.open()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// a size in bytes with an optional KB, MB or GB suffix
+func parseSize(s string) (int64, error) {
+	upper := strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+	for unit, m := range sizeUnits {
+		if strings.HasSuffix(upper, unit) {
+			upper, multiplier = strings.TrimSuffix(upper, unit), m
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(upper), 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("log rotation must be %s or a size like 50MB, got %q", ROTATE_DAILY, s)
+	}
+	return n * multiplier, nil
+}
+
+func (r *RotatingFile) open() error {
+	err := os.MkdirAll(filepath.Dir(r.path), 0o755)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	// a file left over from yesterday is rotated on the first write
+	r.f, r.size, r.day = f, info.Size(), info.ModTime().Format(time.DateOnly)
+	if info.Size() == 0 {
+		r.day = time.Now().Format(time.DateOnly)
+	}
+	return nil
+}
+
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	now := time.Now()
+	if (r.daily && now.Format(time.DateOnly) != r.day) || (r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize) {
+		err := r.rotate(now)
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *RotatingFile) rotate(now time.Time) error {
+	err := r.f.Close()
+	if err != nil {
+		return err
+	}
+	suffix := now.Format("20060102T150405")
+	if r.daily {
+		suffix = r.day
+	}
+	rotated := r.path + "." + suffix
+	// several rotations in the same second or day keep their own files
+	for i := 1; fileExists(rotated); i++ {
+		rotated = fmt.Sprintf("%s.%s.%d", r.path, suffix, i)
+	}
+	err = os.Rename(r.path, rotated)
+	if err != nil {
+		return err
+	}
+	err = r.open()
+	if err != nil {
+		return err
+	}
+	r.day = now.Format(time.DateOnly)
+	return r.prune()
+}
+
+// removes the oldest rotated files past keep, 0 keeps all of them, other files sharing the log's name are left alone
+func (r *RotatingFile) prune() error {
+	if r.keep <= 0 {
+		return nil
+	}
+	matches, err := filepath.Glob(r.path + ".*")
+	if err != nil {
+		return err
+	}
+	rotated := []string{}
+	for _, path := range matches {
+		if rotatedSuffix.MatchString(strings.TrimPrefix(path, r.path+".")) {
+			rotated = append(rotated, path)
+		}
+	}
+	if len(rotated) <= r.keep {
+		return nil
+	}
+	slices.SortFunc(rotated, func(a, b string) int {
+		return modTime(a).Compare(modTime(b))
+	})
+	for _, path := range rotated[:len(rotated)-r.keep] {
+		err = os.Remove(path)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *RotatingFile) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.f.Close()
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
@@ -5,10 +5,12 @@ import (
 	"os"
 
 	"github.com/BushSchoolIT/extractor/cmd"
+	"github.com/BushSchoolIT/extractor/secrets"
 )
 
 func main() {
-	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	// until setupLogging installs the configured handler, redacted all the same
+	logger := slog.New(secrets.Handler(slog.NewTextHandler(os.Stdout, nil)))
 	slog.SetDefault(logger)
 	cmd.Execute()
 }
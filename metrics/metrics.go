@@ -0,0 +1,124 @@
+package metrics
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+/*
+Holds the extractor's own metrics. It's kept apart from the default registry so the textfile written
+after a one-shot command doesn't repeat the go_* and process_* metrics node_exporter already exports.
+*/
+var Registry = prometheus.NewRegistry()
+
+var (
+	APIRequests = register(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bbextract_api_requests_total",
+		Help: "Blackbaud API requests by endpoint and HTTP status, error when no response came back.",
+	}, []string{"endpoint", "status"}))
+	APIRequestDuration = register(prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "bbextract_api_request_duration_seconds",
+		Help:    "Blackbaud API request latency by endpoint.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, []string{"endpoint"}))
+	RateLimitWait = register(prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "bbextract_api_rate_limit_wait_seconds",
+		Help:    "Time requests spent waiting on the client side rate limiter.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 10),
+	}))
+	ListPages = register(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bbextract_list_pages_total",
+		Help: "Advanced list pages read, from the API or storage.",
+	}, []string{"list_id"}))
+	ListRows = register(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bbextract_list_rows_total",
+		Help: "Advanced list rows read, from the API or storage.",
+	}, []string{"list_id"}))
+	RowsUpserted = register(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bbextract_rows_upserted_total",
+		Help: "Rows inserted or updated by table.",
+	}, []string{"table"}))
+	RowsRejected = register(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bbextract_rows_rejected_total",
+		Help: "Rows quarantined in rejected_rows by job.",
+	}, []string{"job"}))
+	TransactionDuration = register(prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "bbextract_transaction_duration_seconds",
+		Help:    "Duration of each job's load transaction.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 12),
+	}, []string{"job"}))
+	TransformDuration = register(prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "bbextract_transform_duration_seconds",
+		Help:    "Duration of each named transform.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 14),
+	}, []string{"transform"}))
+	Runs = register(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bbextract_runs_total",
+		Help: "Finished job runs by status.",
+	}, []string{"job", "status"}))
+	RunDuration = register(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bbextract_run_duration_seconds",
+		Help: "Duration of the job's last run.",
+	}, []string{"job"}))
+	LastRun = register(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bbextract_last_run_timestamp_seconds",
+		Help: "When the job last finished with each status.",
+	}, []string{"job", "status"}))
+)
+
+func register[T prometheus.Collector](c T) T {
+	Registry.MustRegister(c)
+	return c
+}
+
+// observes the time since start in seconds, e.g. defer metrics.Since(h, time.Now())
+func Since(o prometheus.Observer, start time.Time) {
+	o.Observe(time.Since(start).Seconds())
+}
+
+var idSegment = regexp.MustCompile(`^[0-9]+$`)
+
+// the API path without its host, version and IDs so list endpoints share a label, e.g. lists/advanced/:id
+func Endpoint(path string) string {
+	segments := []string{}
+	for _, s := range strings.Split(strings.Trim(path, "/"), "/") {
+		switch {
+		case s == "school" || s == "v1":
+			continue
+		case idSegment.MatchString(s):
+			s = ":id"
+		}
+		segments = append(segments, s)
+	}
+	return strings.Join(segments, "/")
+}
+
+// instruments every request sent through it with APIRequests and APIRequestDuration
+type transport struct {
+	next http.RoundTripper
+}
+
+func Transport(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return transport{next}
+}
+
+func (t transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint := Endpoint(req.URL.Path)
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	Since(APIRequestDuration.WithLabelValues(endpoint), start)
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	APIRequests.WithLabelValues(endpoint, status).Inc()
+	return resp, err
+}
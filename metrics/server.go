@@ -0,0 +1,60 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var ready atomic.Bool
+
+// marks the process as ready to do work, /readyz fails until then
+func SetReady(r bool) {
+	ready.Store(r)
+}
+
+/*
+Serves /metrics (the extractor's metrics along with the go runtime and process ones), /healthz which
+answers as long as the process is up and /readyz which answers once SetReady was called.
+Listening errors are logged, the server is stopped with Shutdown.
+*/
+func Serve(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(prometheus.Gatherers{Registry, prometheus.DefaultGatherer}, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !ready.Load() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Metrics server stopped", slog.String("addr", addr), slog.Any("error", err))
+		}
+	}()
+	slog.Info("Serving metrics", slog.String("addr", addr))
+	return server
+}
+
+func Shutdown(server *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server.Shutdown(ctx)
+}
+
+// writes the extractor's metrics in the text format node_exporter's textfile collector and Pushgateway read
+func WriteTextfile(path string) error {
+	return prometheus.WriteToTextfile(path, Registry)
+}
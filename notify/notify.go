@@ -0,0 +1,281 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"text/template"
+	"time"
+
+	"github.com/BushSchoolIT/extractor/secrets"
+)
+
+const (
+	CHANNEL_SMTP    string = "smtp"
+	CHANNEL_WEBHOOK string = "webhook"
+
+	STATUS_SUCCEEDED string = "succeeded"
+	STATUS_FAILED    string = "failed"
+
+	DEFAULT_SUBJECT string = `[bbextract] {{.Job}} {{.Status}}`
+	DEFAULT_BODY    string = `Job: {{.Job}}
+Run: {{.RunID}}
+Host: {{.Host}}
+Status: {{.Status}}
+Started: {{.StartedAt.Format "2006-01-02 15:04:05 MST"}}
+Duration: {{.Duration.Round 1000000000}}
+{{- if .RowsIn}}
+Rows: {{deref .RowsIn}}
+{{- end}}
+{{- if .Error}}
+Error: {{.Error}}
+{{- end}}
+`
+)
+
+/*
+Where messages about finished runs go. Channels are named so routes can refer to them, routes pick the
+channels for each job and status, quiet hours hold back everything but failures overnight.
+*/
+type Config struct {
+	Channels   map[string]Channel `json:"channels"`
+	Routes     []Route            `json:"routes"`
+	QuietHours *QuietHours        `json:"quiet_hours"`
+}
+
+// an SMTP recipient list or a webhook, Subject and Body override the default templates
+type Channel struct {
+	Type string `json:"type"`
+	// smtp, the password may be a secret reference like env:SMTP_PASSWORD
+	Addr     string   `json:"addr"`
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+	// webhook, the URL may be a secret reference too since it usually carries a token
+	URL    string `json:"url"`
+	Format string `json:"format"`
+
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+// replaces secret references in SMTP passwords and webhook URLs, which carry their token, with the secrets
+func (c *Config) ResolveSecrets() error {
+	for name, channel := range c.Channels {
+		var err error
+		channel.Password, err = secrets.Resolve(channel.Password)
+		if err != nil {
+			return fmt.Errorf("channel %s: %v", name, err)
+		}
+		channel.URL, err = secrets.Resolve(channel.URL)
+		if err != nil {
+			return fmt.Errorf("channel %s: %v", name, err)
+		}
+		// the whole URL since it's only good for posting to this channel
+		secrets.Register(channel.URL)
+		c.Channels[name] = channel
+	}
+	return nil
+}
+
+// sends runs of Jobs (every job when empty) finishing with one of Statuses (failed when empty) to Channels
+type Route struct {
+	Jobs     []string `json:"jobs"`
+	Statuses []string `json:"statuses"`
+	Channels []string `json:"channels"`
+}
+
+func (r Route) matches(e Event) bool {
+	statuses := r.Statuses
+	if len(statuses) == 0 {
+		statuses = []string{STATUS_FAILED}
+	}
+	return (len(r.Jobs) == 0 || slices.Contains(r.Jobs, e.Job)) && slices.Contains(statuses, e.Status)
+}
+
+// a daily window, e.g. 22:00 to 06:00, in which only failures are sent, or nothing with silence_failures
+type QuietHours struct {
+	Start    string `json:"start"`
+	End      string `json:"end"`
+	Timezone string `json:"timezone"`
+	Failures bool   `json:"silence_failures"`
+}
+
+// whether t falls within the window, which may wrap past midnight
+func (q QuietHours) contains(t time.Time) (bool, error) {
+	loc := time.Local
+	if q.Timezone != "" {
+		var err error
+		loc, err = time.LoadLocation(q.Timezone)
+		if err != nil {
+			return false, err
+		}
+	}
+	start, err := time.Parse("15:04", q.Start)
+	if err != nil {
+		return false, fmt.Errorf("quiet hours start %q is not formatted like 22:00", q.Start)
+	}
+	end, err := time.Parse("15:04", q.End)
+	if err != nil {
+		return false, fmt.Errorf("quiet hours end %q is not formatted like 06:00", q.End)
+	}
+	t = t.In(loc)
+	now := t.Hour()*60 + t.Minute()
+	from, to := start.Hour()*60+start.Minute(), end.Hour()*60+end.Minute()
+	if from <= to {
+		return now >= from && now < to, nil
+	}
+	return now >= from || now < to, nil
+}
+
+// a finished run, what the templates are rendered with
+type Event struct {
+	Job       string
+	RunID     string
+	Host      string
+	Status    string
+	StartedAt time.Time
+	Duration  time.Duration
+	RowsIn    *int
+	Error     string
+	Summary   map[string]any
+}
+
+type Notifier struct {
+	config   Config
+	channels map[string]channel
+	// used for webhooks, replaceable so they can be pointed at a test server
+	Client *http.Client
+	// the clock quiet hours are checked against
+	Now func() time.Time
+}
+
+// a configured channel with its templates parsed
+type channel struct {
+	Channel
+	subject *template.Template
+	body    *template.Template
+}
+
+var funcs = template.FuncMap{
+	"deref": func(i *int) int { return *i },
+}
+
+// checks the config and parses every channel's templates
+func New(config Config) (*Notifier, error) {
+	n := &Notifier{
+		config:   config,
+		channels: map[string]channel{},
+		Client:   &http.Client{Timeout: 30 * time.Second},
+		Now:      time.Now,
+	}
+	for name, c := range config.Channels {
+		switch c.Type {
+		case CHANNEL_SMTP:
+			if c.Addr == "" || c.From == "" || len(c.To) == 0 {
+				return nil, fmt.Errorf("smtp channel %s needs addr, from and to", name)
+			}
+		case CHANNEL_WEBHOOK:
+			if c.URL == "" {
+				return nil, fmt.Errorf("webhook channel %s needs a url", name)
+			}
+			if _, ok := webhookFormats[c.Format]; !ok {
+				return nil, fmt.Errorf("webhook channel %s has unknown format %q, use slack, teams or json", name, c.Format)
+			}
+		default:
+			return nil, fmt.Errorf("channel %s must be of type %s or %s, got %q", name, CHANNEL_SMTP, CHANNEL_WEBHOOK, c.Type)
+		}
+		subject, body := c.Subject, c.Body
+		if subject == "" {
+			subject = DEFAULT_SUBJECT
+		}
+		if body == "" {
+			body = DEFAULT_BODY
+		}
+		parsed := channel{Channel: c}
+		var err error
+		parsed.subject, err = template.New(name + " subject").Funcs(funcs).Parse(subject)
+		if err != nil {
+			return nil, fmt.Errorf("channel %s subject: %v", name, err)
+		}
+		parsed.body, err = template.New(name + " body").Funcs(funcs).Parse(body)
+		if err != nil {
+			return nil, fmt.Errorf("channel %s body: %v", name, err)
+		}
+		n.channels[name] = parsed
+	}
+	for i, r := range config.Routes {
+		for _, name := range r.Channels {
+			if _, ok := n.channels[name]; !ok {
+				return nil, fmt.Errorf("route %d refers to unknown channel %s", i+1, name)
+			}
+		}
+	}
+	if q := config.QuietHours; q != nil {
+		if _, err := q.contains(time.Now()); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+// sends e to every channel a route picks for it, once per channel, unless it falls in quiet hours
+func (n *Notifier) Notify(ctx context.Context, e Event) error {
+	if q := n.config.QuietHours; q != nil && (e.Status != STATUS_FAILED || q.Failures) {
+		quiet, err := q.contains(n.Now())
+		if err != nil {
+			return err
+		}
+		if quiet {
+			slog.Info("Not notifying during quiet hours", slog.String("job", e.Job), slog.String("status", e.Status))
+			return nil
+		}
+	}
+	names := []string{}
+	for _, r := range n.config.Routes {
+		if !r.matches(e) {
+			continue
+		}
+		for _, name := range r.Channels {
+			if !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	errs := []error{}
+	for _, name := range names {
+		c := n.channels[name]
+		subject, body, err := c.render(e)
+		if err == nil {
+			err = n.send(ctx, c, subject, body, e)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("channel %s: %v", name, err))
+			continue
+		}
+		slog.Info("Sent notification", slog.String("channel", name), slog.String("job", e.Job), slog.String("status", e.Status))
+	}
+	return errors.Join(errs...)
+}
+
+func (c channel) render(e Event) (string, string, error) {
+	var subject, body bytes.Buffer
+	err := c.subject.Execute(&subject, e)
+	if err != nil {
+		return "", "", err
+	}
+	err = c.body.Execute(&body, e)
+	return subject.String(), body.String(), err
+}
+
+func (n *Notifier) send(ctx context.Context, c channel, subject string, body string, e Event) error {
+	if c.Type == CHANNEL_SMTP {
+		return sendMail(ctx, c.Channel, subject, body)
+	}
+	return n.postWebhook(ctx, c.Channel, subject, body, e)
+}
@@ -0,0 +1,342 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func event(job string, status string) Event {
+	rows := 42
+	return Event{
+		Job:       job,
+		RunID:     "20250101T000000-abcd",
+		Host:      "etl01",
+		Status:    status,
+		StartedAt: time.Date(2025, 1, 1, 2, 0, 0, 0, time.UTC),
+		Duration:  90 * time.Second,
+		RowsIn:    &rows,
+	}
+}
+
+// a webhook server recording the bodies posted to it
+func webhookServer(t *testing.T) (*httptest.Server, func() []map[string]any) {
+	t.Helper()
+	var (
+		lock   sync.Mutex
+		bodies []map[string]any
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := map[string]any{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("webhook body is not JSON: %v", err)
+		}
+		lock.Lock()
+		bodies = append(bodies, body)
+		lock.Unlock()
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []map[string]any {
+		lock.Lock()
+		defer lock.Unlock()
+		return bodies
+	}
+}
+
+func newNotifier(t *testing.T, config Config, client *http.Client) *Notifier {
+	t.Helper()
+	n, err := New(config)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	n.Client = client
+	return n
+}
+
+func TestRouteMatches(t *testing.T) {
+	tests := []struct {
+		name  string
+		route Route
+		event Event
+		want  bool
+	}{
+		{"failures by default", Route{}, event("transcripts", STATUS_FAILED), true},
+		{"successes need a status", Route{}, event("transcripts", STATUS_SUCCEEDED), false},
+		{"listed status", Route{Statuses: []string{STATUS_SUCCEEDED, STATUS_FAILED}}, event("gpa", STATUS_SUCCEEDED), true},
+		{"listed job", Route{Jobs: []string{"gpa", "parents"}}, event("parents", STATUS_FAILED), true},
+		{"other job", Route{Jobs: []string{"gpa"}}, event("transcripts", STATUS_FAILED), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.route.matches(tt.event); got != tt.want {
+				t.Errorf("matches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNotifyRoutesToEachChannelOnce(t *testing.T) {
+	server, bodies := webhookServer(t)
+	n := newNotifier(t, Config{
+		Channels: map[string]Channel{
+			"ops":  {Type: CHANNEL_WEBHOOK, URL: server.URL},
+			"data": {Type: CHANNEL_WEBHOOK, URL: server.URL},
+		},
+		Routes: []Route{
+			{Channels: []string{"ops"}},
+			{Jobs: []string{"transcripts"}, Statuses: []string{STATUS_FAILED}, Channels: []string{"ops", "data"}},
+			{Jobs: []string{"gpa"}, Channels: []string{"data"}},
+		},
+	}, server.Client())
+	err := n.Notify(context.Background(), event("transcripts", STATUS_FAILED))
+	if err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	if got := len(bodies()); got != 2 {
+		t.Errorf("sent %d messages, want one each to ops and data", got)
+	}
+	err = n.Notify(context.Background(), event("transcripts", STATUS_SUCCEEDED))
+	if err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	if got := len(bodies()); got != 2 {
+		t.Errorf("a success with no route for it sent %d more messages", got-2)
+	}
+}
+
+func TestQuietHours(t *testing.T) {
+	at := func(hour int, minute int) func() time.Time {
+		return func() time.Time { return time.Date(2025, 3, 4, hour, minute, 0, 0, time.UTC) }
+	}
+	tests := []struct {
+		name     string
+		now      func() time.Time
+		status   string
+		failures bool
+		want     int
+	}{
+		{"before the window", at(21, 59), STATUS_SUCCEEDED, false, 1},
+		{"start of the window", at(22, 0), STATUS_SUCCEEDED, false, 0},
+		{"past midnight", at(3, 30), STATUS_SUCCEEDED, false, 0},
+		{"end of the window", at(6, 0), STATUS_SUCCEEDED, false, 1},
+		{"failures still go out", at(23, 0), STATUS_FAILED, false, 1},
+		{"silenced failures", at(23, 0), STATUS_FAILED, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, bodies := webhookServer(t)
+			n := newNotifier(t, Config{
+				Channels:   map[string]Channel{"ops": {Type: CHANNEL_WEBHOOK, URL: server.URL}},
+				Routes:     []Route{{Statuses: []string{STATUS_SUCCEEDED, STATUS_FAILED}, Channels: []string{"ops"}}},
+				QuietHours: &QuietHours{Start: "22:00", End: "06:00", Timezone: "UTC", Failures: tt.failures},
+			}, server.Client())
+			n.Now = tt.now
+			err := n.Notify(context.Background(), event("gpa", tt.status))
+			if err != nil {
+				t.Fatalf("Notify: %v", err)
+			}
+			if got := len(bodies()); got != tt.want {
+				t.Errorf("sent %d messages, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWebhookPayloads(t *testing.T) {
+	tests := []struct {
+		format string
+		check  func(t *testing.T, body map[string]any)
+	}{
+		{FORMAT_SLACK, func(t *testing.T, body map[string]any) {
+			text, _ := body["text"].(string)
+			if !strings.HasPrefix(text, "*[bbextract] transcripts failed*") || !strings.Contains(text, "Rows: 42") {
+				t.Errorf("slack text = %q", text)
+			}
+		}},
+		{FORMAT_TEAMS, func(t *testing.T, body map[string]any) {
+			if body["@type"] != "MessageCard" || body["title"] != "[bbextract] transcripts failed" || body["themeColor"] != "D00000" {
+				t.Errorf("teams card = %v", body)
+			}
+			if text, _ := body["text"].(string); !strings.Contains(text, "Error: list 123 is incomplete") {
+				t.Errorf("teams text = %q", text)
+			}
+		}},
+		{FORMAT_JSON, func(t *testing.T, body map[string]any) {
+			want := map[string]any{
+				"job":              "transcripts",
+				"status":           STATUS_FAILED,
+				"host":             "etl01",
+				"rows_in":          42.0,
+				"duration_seconds": 90.0,
+				"started_at":       "2025-01-01T02:00:00Z",
+				"error":            "list 123 is incomplete",
+			}
+			for k, v := range want {
+				if body[k] != v {
+					t.Errorf("%s = %v, want %v", k, body[k], v)
+				}
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			server, bodies := webhookServer(t)
+			n := newNotifier(t, Config{
+				Channels: map[string]Channel{"hook": {Type: CHANNEL_WEBHOOK, URL: server.URL, Format: tt.format}},
+				Routes:   []Route{{Channels: []string{"hook"}}},
+			}, server.Client())
+			e := event("transcripts", STATUS_FAILED)
+			e.Error = "list 123 is incomplete"
+			err := n.Notify(context.Background(), e)
+			if err != nil {
+				t.Fatalf("Notify: %v", err)
+			}
+			if len(bodies()) != 1 {
+				t.Fatalf("sent %d messages, want 1", len(bodies()))
+			}
+			tt.check(t, bodies()[0])
+		})
+	}
+}
+
+func TestWebhookErrorStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "invalid_token", http.StatusForbidden)
+	}))
+	defer server.Close()
+	n := newNotifier(t, Config{
+		Channels: map[string]Channel{"hook": {Type: CHANNEL_WEBHOOK, URL: server.URL}},
+		Routes:   []Route{{Channels: []string{"hook"}}},
+	}, server.Client())
+	err := n.Notify(context.Background(), event("gpa", STATUS_FAILED))
+	if err == nil || !strings.Contains(err.Error(), "403") || !strings.Contains(err.Error(), "invalid_token") {
+		t.Errorf("Notify = %v, want the status and body", err)
+	}
+}
+
+// a mail received by smtpSink
+type mail struct {
+	from string
+	to   []string
+	data string
+}
+
+// a minimal SMTP server without TLS or auth that records what it's sent
+func smtpSink(t *testing.T) (string, <-chan mail) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	mails := make(chan mail, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		text := textproto.NewConn(conn)
+		m := mail{}
+		text.PrintfLine("220 sink ready")
+		for {
+			line, err := text.ReadLine()
+			if err != nil {
+				return
+			}
+			verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+			switch {
+			case verb == "EHLO" || verb == "HELO":
+				text.PrintfLine("250 sink")
+			case strings.HasPrefix(strings.ToUpper(line), "MAIL FROM:"):
+				m.from = strings.Trim(line[len("MAIL FROM:"):], "<>")
+				text.PrintfLine("250 ok")
+			case strings.HasPrefix(strings.ToUpper(line), "RCPT TO:"):
+				m.to = append(m.to, strings.Trim(line[len("RCPT TO:"):], "<>"))
+				text.PrintfLine("250 ok")
+			case verb == "DATA":
+				text.PrintfLine("354 go ahead")
+				data, err := io.ReadAll(text.DotReader())
+				if err != nil {
+					return
+				}
+				m.data = string(data)
+				mails <- m
+				text.PrintfLine("250 queued")
+			case verb == "QUIT":
+				text.PrintfLine("221 bye")
+				return
+			default:
+				text.PrintfLine("502 not implemented")
+			}
+		}
+	}()
+	return l.Addr().String(), mails
+}
+
+func TestSendMail(t *testing.T) {
+	addr, mails := smtpSink(t)
+	c := Channel{Type: CHANNEL_SMTP, Addr: addr, From: "etl@example.org", To: []string{"it@example.org", "data@example.org"}}
+	err := sendMail(context.Background(), c, "[bbextract] gpa failed", "Job: gpa\nStatus: failed\n")
+	if err != nil {
+		t.Fatalf("sendMail: %v", err)
+	}
+	m := <-mails
+	if m.from != c.From || strings.Join(m.to, ",") != "it@example.org,data@example.org" {
+		t.Errorf("envelope from %s to %v", m.from, m.to)
+	}
+	msg, err := textproto.NewReader(bufio.NewReader(strings.NewReader(m.data))).ReadMIMEHeader()
+	if err != nil {
+		t.Fatalf("headers: %v", err)
+	}
+	if msg.Get("Subject") != "[bbextract] gpa failed" || msg.Get("To") != "it@example.org, data@example.org" {
+		t.Errorf("headers = %v", msg)
+	}
+	if !strings.Contains(m.data, "\nJob: gpa\nStatus: failed\n") {
+		t.Errorf("body = %q", m.data)
+	}
+}
+
+func TestSendMailNeedsAuthForUsername(t *testing.T) {
+	addr, _ := smtpSink(t)
+	c := Channel{Type: CHANNEL_SMTP, Addr: addr, Username: "etl", Password: "hunter22", From: "etl@example.org", To: []string{"it@example.org"}}
+	err := sendMail(context.Background(), c, "subject", "body")
+	if err == nil || !strings.Contains(err.Error(), "AUTH") {
+		t.Errorf("sendMail = %v, want an error about AUTH", err)
+	}
+}
+
+func TestSendMailTimeout(t *testing.T) {
+	// accepts the connection but never greets
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			defer conn.Close()
+			io.Copy(io.Discard, conn)
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = sendMail(ctx, Channel{Addr: l.Addr().String(), From: "etl@example.org", To: []string{"it@example.org"}}, "subject", "body")
+	if err == nil {
+		t.Fatal("sendMail to a relay that never answers succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("sendMail took %v, past its deadline", elapsed)
+	}
+}
@@ -0,0 +1,168 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+const (
+	// {"text": ...}, also understood by Mattermost, Rocket.Chat and Google Chat
+	FORMAT_SLACK string = "slack"
+	// an Office 365 connector MessageCard, accepted by Teams incoming webhooks and workflows
+	FORMAT_TEAMS string = "teams"
+	// the event itself along with the rendered subject and text
+	FORMAT_JSON string = "json"
+)
+
+var webhookFormats = map[string]func(subject string, body string, e Event) any{
+	"":           slackPayload,
+	FORMAT_SLACK: slackPayload,
+	FORMAT_TEAMS: teamsPayload,
+	FORMAT_JSON:  jsonPayload,
+}
+
+func slackPayload(subject string, body string, e Event) any {
+	return map[string]string{"text": fmt.Sprintf("*%s*\n```%s```", subject, body)}
+}
+
+func teamsPayload(subject string, body string, e Event) any {
+	color := "2EB886"
+	if e.Status == STATUS_FAILED {
+		color = "D00000"
+	}
+	return map[string]string{
+		"@type":      "MessageCard",
+		"@context":   "http://schema.org/extensions",
+		"summary":    subject,
+		"title":      subject,
+		"themeColor": color,
+		// Teams renders the text as markdown, preformatted keeps the body's line breaks
+		"text": "<pre>" + body + "</pre>",
+	}
+}
+
+func jsonPayload(subject string, body string, e Event) any {
+	return struct {
+		Subject string `json:"subject"`
+		Text    string `json:"text"`
+		Job     string `json:"job"`
+		RunID   string `json:"run_id"`
+		Host    string `json:"host"`
+		Status  string `json:"status"`
+		Started string `json:"started_at"`
+		Seconds int64  `json:"duration_seconds"`
+		RowsIn  *int   `json:"rows_in"`
+		Error   string `json:"error,omitempty"`
+	}{subject, body, e.Job, e.RunID, e.Host, e.Status, e.StartedAt.Format(time.RFC3339), int64(e.Duration.Seconds()), e.RowsIn, e.Error}
+}
+
+func (n *Notifier) postWebhook(ctx context.Context, c Channel, subject string, body string, e Event) error {
+	payload, err := json.Marshal(webhookFormats[c.Format](subject, body, e))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("webhook returned status %d: %s", resp.StatusCode, string(respBody))
+	}
+	return nil
+}
+
+/*
+Sends a plain text mail through the relay at c.Addr. STARTTLS is used when the server offers it and
+credentials are only sent when a username is set, so a local sink without TLS or auth works too. The
+connection is bound to ctx so a relay that stops answering can't hold up the run past its deadline.
+*/
+func sendMail(ctx context.Context, c Channel, subject string, body string) (err error) {
+	defer func() {
+		// closing the connection on cancel shows up as a read error, the deadline is what happened
+		if err != nil && ctx.Err() != nil {
+			err = fmt.Errorf("%v: %v", ctx.Err(), err)
+		}
+	}()
+	host, _, err := net.SplitHostPort(c.Addr)
+	if err != nil {
+		return err
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", c.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		err = client.StartTLS(&tls.Config{ServerName: host})
+		if err != nil {
+			return err
+		}
+	}
+	if c.Username != "" {
+		if ok, _ := client.Extension("AUTH"); !ok {
+			return fmt.Errorf("%s doesn't support AUTH but a username is set", c.Addr)
+		}
+		err = client.Auth(smtp.PlainAuth("", c.Username, c.Password, host))
+		if err != nil {
+			return err
+		}
+	}
+	err = client.Mail(c.From)
+	if err != nil {
+		return err
+	}
+	for _, to := range c.To {
+		err = client.Rcpt(to)
+		if err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	headers := []string{
+		"From: " + c.From,
+		"To: " + strings.Join(c.To, ", "),
+		"Subject: " + subject,
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+	}
+	_, err = io.WriteString(w, strings.Join(headers, "\r\n")+"\r\n\r\n"+strings.ReplaceAll(body, "\n", "\r\n"))
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	return client.Quit()
+}
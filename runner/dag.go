@@ -0,0 +1,132 @@
+package runner
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	STAGE_SUCCEEDED string = "succeeded"
+	STAGE_FAILED    string = "failed"
+	// not run because a stage it needs failed or was skipped
+	STAGE_SKIPPED string = "skipped"
+)
+
+// a step of a pipeline, run once every stage it needs succeeded
+type Stage struct {
+	Name  string   `json:"name"`
+	Needs []string `json:"needs"`
+}
+
+type StageResult struct {
+	Name     string
+	Status   string
+	Duration time.Duration
+	Err      error
+}
+
+// checks stage names are unique, needs refer to stages and there are no cycles
+func CheckDAG(stages []Stage) error {
+	byName := map[string]Stage{}
+	for _, s := range stages {
+		if s.Name == "" {
+			return fmt.Errorf("every stage needs a name")
+		}
+		if _, ok := byName[s.Name]; ok {
+			return fmt.Errorf("stage %s is defined twice", s.Name)
+		}
+		byName[s.Name] = s
+	}
+	// 1 while a stage's needs are being visited, 2 once they all were
+	state := map[string]int{}
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case 1:
+			return fmt.Errorf("stages depend on each other in a cycle: %v", append(path, name))
+		case 2:
+			return nil
+		}
+		state[name] = 1
+		for _, need := range byName[name].Needs {
+			if _, ok := byName[need]; !ok {
+				return fmt.Errorf("stage %s needs unknown stage %s", name, need)
+			}
+			if err := visit(need, append(path, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = 2
+		return nil
+	}
+	for _, s := range stages {
+		if err := visit(s.Name, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Runs every stage once the stages it needs succeeded, stages that don't depend on each other run at the
+same time. When a stage fails the stages depending on it, directly or not, are skipped while the rest
+carry on. Results are returned in the order of stages, the DAG must have passed CheckDAG.
+*/
+func RunDAG(stages []Stage, fn func(name string) error) []StageResult {
+	results := make([]StageResult, len(stages))
+	index := map[string]int{}
+	for i, s := range stages {
+		index[s.Name] = i
+		results[i].Name = s.Name
+	}
+	done := make(chan int)
+	finished := map[string]bool{}
+	started := map[string]bool{}
+	running := 0
+	for len(finished) < len(stages) {
+		for i, s := range stages {
+			if started[s.Name] {
+				continue
+			}
+			ready, skip := true, false
+			for _, need := range s.Needs {
+				if !finished[need] {
+					ready = false
+					break
+				}
+				if results[index[need]].Status != STAGE_SUCCEEDED {
+					skip = true
+				}
+			}
+			if !ready {
+				continue
+			}
+			started[s.Name] = true
+			if skip {
+				results[i].Status = STAGE_SKIPPED
+				finished[s.Name] = true
+				continue
+			}
+			running++
+			go func() {
+				start := time.Now()
+				err := fn(s.Name)
+				results[i].Duration = time.Since(start)
+				results[i].Err = err
+				results[i].Status = STAGE_SUCCEEDED
+				if err != nil {
+					results[i].Status = STAGE_FAILED
+				}
+				done <- i
+			}()
+		}
+		if running == 0 {
+			// skipped stages may have unblocked others, look again
+			continue
+		}
+		i := <-done
+		running--
+		finished[stages[i].Name] = true
+	}
+	return results
+}
@@ -0,0 +1,64 @@
+package runner
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// the outcome of one task, e.g. fetching one advanced list
+type Result[T any] struct {
+	ID    string
+	Value T
+	Err   error
+}
+
+/*
+Runs fn for every ID with at most concurrency running at once (1 or less runs them one at a time).
+Every task runs to completion whether or not the others fail, results are returned in the order of ids.
+*/
+func Run[T any](ids []string, concurrency int, fn func(id string) (T, error)) []Result[T] {
+	concurrency = max(concurrency, 1)
+	results := make([]Result[T], len(ids))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			value, err := fn(id)
+			results[i] = Result[T]{ID: id, Value: value, Err: err}
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// splits results into the ones that succeeded and the ones that failed
+func Partition[T any](results []Result[T]) ([]Result[T], []Result[T]) {
+	succeeded, failed := []Result[T]{}, []Result[T]{}
+	for _, r := range results {
+		if r.Err != nil {
+			failed = append(failed, r)
+			continue
+		}
+		succeeded = append(succeeded, r)
+	}
+	return succeeded, failed
+}
+
+// a single error describing every failed task, nil if none failed
+func Errors[T any](results []Result[T]) error {
+	messages := []string{}
+	for _, r := range results {
+		if r.Err != nil {
+			messages = append(messages, fmt.Sprintf("%s: %v", r.ID, r.Err))
+		}
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d of %d failed: %s", len(messages), len(results), strings.Join(messages, "; "))
+}
@@ -0,0 +1,208 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+const (
+	DEFAULT_BACKOFF = time.Minute
+	MAX_BACKOFF     = time.Hour
+)
+
+// why a job was run, recorded with the run
+const (
+	REASON_SCHEDULE string = "schedule"
+	REASON_CATCH_UP string = "catch-up"
+	REASON_RETRY    string = "retry"
+)
+
+// standard five field crons plus descriptors like @daily and @every 6h
+const cronParseOptions = cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor
+
+/*
+A command run on a cron schedule, e.g. {"name": "attendance", "cron": "0 3 * * *", "args": ["attendance"]}.
+Cron takes five fields or a descriptor like @daily, prefix it with CRON_TZ=America/Chicago to use a time
+zone other than the local one. A failed run is retried Retries times, waiting Backoff (1m by default)
+before the first retry and twice as long before each next one, up to an hour.
+*/
+type Job struct {
+	Name    string   `json:"name"`
+	Cron    string   `json:"cron"`
+	Args    []string `json:"args"`
+	Retries int      `json:"retries"`
+	Backoff string   `json:"backoff"`
+}
+
+// runs a job's command, attempt starts at 1
+type RunFunc func(ctx context.Context, job Job, attempt int, reason string) error
+
+// when a job last ran, false if it never did
+type LastRunFunc func(job Job) (time.Time, bool, error)
+
+type entry struct {
+	Job
+	spec    cron.Schedule
+	backoff time.Duration
+	next    time.Time
+	// queued, running or waiting to be retried, further ticks are skipped until it's done
+	busy bool
+}
+
+type request struct {
+	entry   *entry
+	attempt int
+	reason  string
+}
+
+type result struct {
+	request
+	err error
+}
+
+/*
+Runs jobs on their schedules one at a time, in the order they come due. A job that is still queued,
+running or waiting for a retry when it comes due again is skipped instead of piling up, and a job
+whose last run is older than its most recent scheduled time is run once on start to catch up.
+*/
+type Scheduler struct {
+	entries []*entry
+	run     RunFunc
+	lastRun LastRunFunc
+}
+
+func New(jobs []Job, run RunFunc, lastRun LastRunFunc) (*Scheduler, error) {
+	parser := cron.NewParser(cronParseOptions)
+	s := &Scheduler{run: run, lastRun: lastRun}
+	names := map[string]bool{}
+	for _, j := range jobs {
+		if j.Name == "" {
+			return nil, fmt.Errorf("schedule %q needs a name", j.Cron)
+		}
+		if names[j.Name] {
+			return nil, fmt.Errorf("schedule %s is defined twice", j.Name)
+		}
+		names[j.Name] = true
+		spec, err := parser.Parse(j.Cron)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %s: invalid cron %q: %v", j.Name, j.Cron, err)
+		}
+		backoff := DEFAULT_BACKOFF
+		if j.Backoff != "" {
+			backoff, err = time.ParseDuration(j.Backoff)
+			if err != nil || backoff <= 0 {
+				return nil, fmt.Errorf("schedule %s: backoff %q is not a positive duration like 5m", j.Name, j.Backoff)
+			}
+		}
+		if j.Retries < 0 {
+			return nil, fmt.Errorf("schedule %s: retries can't be negative", j.Name)
+		}
+		s.entries = append(s.entries, &entry{Job: j, spec: spec, backoff: backoff})
+	}
+	return s, nil
+}
+
+// the wait before retry attempt, doubling from the job's backoff
+func (e *entry) delay(attempt int) time.Duration {
+	d := e.backoff
+	for i := 2; i < attempt && d < MAX_BACKOFF; i++ {
+		d *= 2
+	}
+	return min(d, MAX_BACKOFF)
+}
+
+/*
+Schedules jobs until ctx is cancelled, then waits for the running job to finish, queued ones are dropped.
+Runs get a context that isn't cancelled with ctx so a shutdown doesn't abort a load halfway.
+*/
+func (s *Scheduler) Run(ctx context.Context) error {
+	if len(s.entries) == 0 {
+		return fmt.Errorf("no schedules configured")
+	}
+	// every entry has at most one request outstanding so neither channel ever blocks
+	queue := make(chan request, len(s.entries))
+	done := make(chan result, len(s.entries))
+	retries := make(chan request)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		runCtx := context.WithoutCancel(ctx)
+		for r := range queue {
+			if ctx.Err() != nil {
+				continue
+			}
+			done <- result{r, s.run(runCtx, r.entry.Job, r.attempt, r.reason)}
+		}
+	}()
+
+	now := time.Now()
+	for _, e := range s.entries {
+		e.next = e.spec.Next(now)
+		slog.Info("Scheduled job", slog.String("schedule", e.Name), slog.String("cron", e.Cron), slog.Time("next", e.next))
+		last, ok, err := s.lastRun(e.Job)
+		if err != nil {
+			slog.Error("Unable to get last run, not catching up", slog.String("schedule", e.Name), slog.Any("error", err))
+			continue
+		}
+		if ok && e.spec.Next(last).Before(now) {
+			slog.Info("Catching up on missed run", slog.String("schedule", e.Name), slog.Time("last_run", last))
+			e.busy = true
+			queue <- request{e, 1, REASON_CATCH_UP}
+		}
+	}
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		next := s.entries[0].next
+		for _, e := range s.entries[1:] {
+			if e.next.Before(next) {
+				next = e.next
+			}
+		}
+		timer.Reset(time.Until(next))
+		select {
+		case <-ctx.Done():
+			slog.Info("Stopping scheduler, waiting for the running job")
+			close(queue)
+			<-stopped
+			return nil
+		case now := <-timer.C:
+			for _, e := range s.entries {
+				if e.next.After(now) {
+					continue
+				}
+				e.next = e.spec.Next(now)
+				if e.busy {
+					slog.Warn("Skipping run, the previous one hasn't finished", slog.String("schedule", e.Name), slog.Time("next", e.next))
+					continue
+				}
+				e.busy = true
+				queue <- request{e, 1, REASON_SCHEDULE}
+			}
+		case r := <-done:
+			if r.err == nil || r.attempt > r.entry.Retries {
+				if r.err != nil {
+					slog.Error("Scheduled run failed, giving up", slog.String("schedule", r.entry.Name), slog.Int("attempt", r.attempt), slog.Any("error", r.err))
+				}
+				r.entry.busy = false
+				continue
+			}
+			delay := r.entry.delay(r.attempt + 1)
+			slog.Warn("Scheduled run failed, retrying", slog.String("schedule", r.entry.Name), slog.Int("attempt", r.attempt), slog.Duration("backoff", delay), slog.Any("error", r.err))
+			retry := request{r.entry, r.attempt + 1, REASON_RETRY}
+			time.AfterFunc(delay, func() {
+				select {
+				case retries <- retry:
+				case <-ctx.Done():
+				}
+			})
+		case r := <-retries:
+			queue <- r
+		}
+	}
+}
@@ -46,6 +46,268 @@ ALTER TABLE ONLY public.parents
     ADD CONSTRAINT parents_pkey PRIMARY KEY (email);
 
 
+--
+-- Name: gpa; Type: TABLE; Schema: public; Owner: postgres
+-- One row per student per GPA definition (see gpa_definitions in config.json).
+-- Migrating from the single calculated_gpa table:
+--   ALTER TABLE public.gpa ADD COLUMN definition character varying NOT NULL DEFAULT 'default';
+--   ALTER TABLE public.gpa DROP CONSTRAINT gpa_pkey, ADD CONSTRAINT gpa_pkey PRIMARY KEY (student_user_id, definition);
+--
+
+CREATE TABLE public.gpa (
+    student_user_id integer NOT NULL,
+    definition character varying NOT NULL,
+    calculated_gpa numeric
+);
+
+
+ALTER TABLE public.gpa OWNER TO postgres;
+
+ALTER TABLE ONLY public.gpa
+    ADD CONSTRAINT gpa_pkey PRIMARY KEY (student_user_id, definition);
+
+
+--
+-- Name: gpa_history; Type: TABLE; Schema: public; Owner: postgres
+-- Term and cumulative-to-date GPA per school_year and grading period, per GPA definition.
+--
+
+CREATE TABLE public.gpa_history (
+    student_user_id integer NOT NULL,
+    definition character varying NOT NULL,
+    school_year character varying NOT NULL,
+    grading_period character varying NOT NULL,
+    term_gpa numeric,
+    term_credits numeric,
+    cumulative_gpa numeric,
+    cumulative_credits numeric
+);
+
+
+ALTER TABLE public.gpa_history OWNER TO postgres;
+
+ALTER TABLE ONLY public.gpa_history
+    ADD CONSTRAINT gpa_history_pkey PRIMARY KEY (student_user_id, definition, school_year, grading_period);
+
+
+--
+-- Name: course_codes; Type: TABLE; Schema: public; Owner: postgres
+-- Maps course code prefixes to transcript categories, managed with `bbextract course-codes`.
+--
+
+CREATE TABLE public.course_codes (
+    course_prefix character varying NOT NULL,
+    transcript_category character varying NOT NULL
+);
+
+
+ALTER TABLE public.course_codes OWNER TO postgres;
+
+ALTER TABLE ONLY public.course_codes
+    ADD CONSTRAINT course_codes_pkey PRIMARY KEY (course_prefix);
+
+
+--
+-- Name: rejected_rows; Type: TABLE; Schema: public; Owner: postgres
+-- Rows dropped for null primary keys or that failed to insert, listed with `bbextract rejects`.
+--
+
+CREATE TABLE public.rejected_rows (
+    id bigint GENERATED ALWAYS AS IDENTITY,
+    job character varying NOT NULL,
+    run_id character varying NOT NULL,
+    reason text NOT NULL,
+    "row" jsonb NOT NULL,
+    rejected_at timestamp with time zone DEFAULT now() NOT NULL
+);
+
+
+ALTER TABLE public.rejected_rows OWNER TO postgres;
+
+ALTER TABLE ONLY public.rejected_rows
+    ADD CONSTRAINT rejected_rows_pkey PRIMARY KEY (id);
+
+CREATE INDEX rejected_rows_run_idx ON public.rejected_rows USING btree (job, run_id);
+
+
+--
+-- Name: runs; Type: TABLE; Schema: public; Owner: postgres
+-- Audit trail of every ETL job run, also the baseline for the row count guard.
+--
+
+CREATE TABLE public.runs (
+    run_id character varying NOT NULL,
+    job character varying NOT NULL,
+    status character varying NOT NULL,
+    started_at timestamp with time zone DEFAULT now() NOT NULL,
+    finished_at timestamp with time zone,
+    rows_in integer,
+    host character varying,
+    pid integer,
+    error text,
+    summary jsonb,
+    incremental boolean DEFAULT false NOT NULL,
+    backend_pid integer,
+    schedule character varying,
+    attempt integer
+);
+
+
+ALTER TABLE public.runs OWNER TO postgres;
+
+ALTER TABLE ONLY public.runs
+    ADD CONSTRAINT runs_pkey PRIMARY KEY (run_id, job);
+
+CREATE INDEX runs_job_idx ON public.runs USING btree (job, status, finished_at);
+
+CREATE INDEX runs_schedule_idx ON public.runs USING btree (schedule, started_at);
+
+
+--
+-- Name: list_schemas; Type: TABLE; Schema: public; Owner: postgres
+-- Column layout of every advanced list as of the last run, used to detect schema drift.
+--
+
+CREATE TABLE public.list_schemas (
+    list_id character varying NOT NULL,
+    columns text[] NOT NULL,
+    fingerprint character varying NOT NULL,
+    updated_at timestamp with time zone DEFAULT now() NOT NULL
+);
+
+
+ALTER TABLE public.list_schemas OWNER TO postgres;
+
+ALTER TABLE ONLY public.list_schemas
+    ADD CONSTRAINT list_schemas_pkey PRIMARY KEY (list_id);
+
+
+--
+-- Name: watermarks; Type: TABLE; Schema: public; Owner: postgres
+-- High-water mark of every incremental job and when it last did a full refresh.
+--
+
+CREATE TABLE public.watermarks (
+    job character varying NOT NULL,
+    mark character varying NOT NULL,
+    last_full_refresh timestamp with time zone NOT NULL,
+    updated_at timestamp with time zone DEFAULT now() NOT NULL
+);
+
+
+ALTER TABLE public.watermarks OWNER TO postgres;
+
+ALTER TABLE ONLY public.watermarks
+    ADD CONSTRAINT watermarks_pkey PRIMARY KEY (job);
+
+
+--
+-- Name: list_checkpoints; Type: TABLE; Schema: public; Owner: postgres
+-- Pages fetched by a job that hasn't committed yet, so `--resume` can continue a failed run.
+--
+
+CREATE TABLE public.list_checkpoints (
+    job character varying NOT NULL,
+    list_id character varying NOT NULL,
+    params character varying NOT NULL,
+    page integer NOT NULL,
+    run_id character varying NOT NULL,
+    data jsonb NOT NULL,
+    fetched_at timestamp with time zone DEFAULT now() NOT NULL
+);
+
+
+ALTER TABLE public.list_checkpoints OWNER TO postgres;
+
+ALTER TABLE ONLY public.list_checkpoints
+    ADD CONSTRAINT list_checkpoints_pkey PRIMARY KEY (job, list_id, params, page);
+
+
+--
+-- Name: list_progress; Type: TABLE; Schema: public; Owner: postgres
+-- Per-list progress of the checkpointed pages.
+--
+
+CREATE TABLE public.list_progress (
+    job character varying NOT NULL,
+    list_id character varying NOT NULL,
+    params character varying NOT NULL,
+    pages integer NOT NULL,
+    complete boolean DEFAULT false NOT NULL,
+    updated_at timestamp with time zone DEFAULT now() NOT NULL
+);
+
+
+ALTER TABLE public.list_progress OWNER TO postgres;
+
+ALTER TABLE ONLY public.list_progress
+    ADD CONSTRAINT list_progress_pkey PRIMARY KEY (job, list_id, params);
+
+
+--
+-- Name: raw_pages; Type: TABLE; Schema: public; Owner: postgres
+-- Landing zone for the raw JSON of every fetched list page, replayed with `bbextract reprocess`.
+--
+
+CREATE TABLE public.raw_pages (
+    run_id character varying NOT NULL,
+    job character varying NOT NULL,
+    list_id character varying NOT NULL,
+    page integer NOT NULL,
+    params character varying NOT NULL,
+    body jsonb NOT NULL,
+    fetched_at timestamp with time zone DEFAULT now() NOT NULL
+);
+
+
+ALTER TABLE public.raw_pages OWNER TO postgres;
+
+ALTER TABLE ONLY public.raw_pages
+    ADD CONSTRAINT raw_pages_pkey PRIMARY KEY (run_id, job, list_id, page);
+
+
+--
+-- Name: job_queue; Type: TABLE; Schema: public; Owner: postgres
+-- Commands queued with `bbextract enqueue` and claimed by `bbextract worker` processes on any host.
+--
+
+CREATE TABLE public.job_queue (
+    id bigint GENERATED ALWAYS AS IDENTITY,
+    args text[] NOT NULL,
+    status character varying DEFAULT 'queued'::character varying NOT NULL,
+    attempts integer DEFAULT 0 NOT NULL,
+    max_attempts integer DEFAULT 3 NOT NULL,
+    run_at timestamp with time zone DEFAULT now() NOT NULL,
+    enqueued_at timestamp with time zone DEFAULT now() NOT NULL,
+    worker character varying,
+    run_id character varying,
+    started_at timestamp with time zone,
+    lease_expires_at timestamp with time zone,
+    finished_at timestamp with time zone,
+    error text
+);
+
+
+ALTER TABLE public.job_queue OWNER TO postgres;
+
+ALTER TABLE ONLY public.job_queue
+    ADD CONSTRAINT job_queue_pkey PRIMARY KEY (id);
+
+CREATE INDEX job_queue_claim_idx ON public.job_queue USING btree (status, run_at);
+
+
+--
+-- Name: deleted_at; Type: COLUMN; Schema: public; Owner: postgres
+-- Set on rows deleted in blackbaud by jobs whose sync mode in config.json is soft-delete, and cleared if
+-- they come back. Needed on every table such a job syncs.
+--
+
+ALTER TABLE public.transcripts ADD COLUMN IF NOT EXISTS deleted_at timestamp with time zone;
+ALTER TABLE public.transcript_comments ADD COLUMN IF NOT EXISTS deleted_at timestamp with time zone;
+ALTER TABLE public.enrollment ADD COLUMN IF NOT EXISTS deleted_at timestamp with time zone;
+ALTER TABLE public.attendance ADD COLUMN IF NOT EXISTS deleted_at timestamp with time zone;
+
+
 -- Completed on 2025-07-18 11:59:40
 
 --
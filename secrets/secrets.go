@@ -0,0 +1,126 @@
+package secrets
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const (
+	// env:NAME, the value of an environment variable
+	REF_ENV string = "env:"
+	// file:/run/secrets/x, the contents of a file such as a docker or kubernetes secret
+	REF_FILE string = "file:"
+	REDACTED string = "[REDACTED]"
+	// shorter secrets aren't redacted, they'd turn up inside unrelated words
+	MIN_LENGTH int = 6
+)
+
+var (
+	lock sync.RWMutex
+	// every secret value resolved or registered so far, replaced by Redact
+	known = []string{}
+)
+
+/*
+The secret a config value refers to: env:NAME reads an environment variable and file:/path a file,
+without its trailing newline, and registers it so Redact hides it. Anything else is taken as the secret
+itself and isn't registered, a literal may well be an ordinary word like the documented postgres
+password, callers Register literals known to be random such as API tokens.
+*/
+func Resolve(value string) (string, error) {
+	var secret string
+	switch {
+	case strings.HasPrefix(value, REF_ENV):
+		name := strings.TrimPrefix(value, REF_ENV)
+		var ok bool
+		secret, ok = os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("secret %s: environment variable %s is not set", value, name)
+		}
+	case strings.HasPrefix(value, REF_FILE):
+		data, err := os.ReadFile(strings.TrimPrefix(value, REF_FILE))
+		if err != nil {
+			return "", fmt.Errorf("secret %s: %v", value, err)
+		}
+		secret = strings.TrimRight(string(data), "\r\n")
+	default:
+		return value, nil
+	}
+	Register(secret)
+	return secret, nil
+}
+
+/*
+Saves a new secret where value refers to it, e.g. a refreshed token: a file: reference has its file
+rewritten and is returned as is, a literal is replaced by the secret. An env: reference can't be
+written so it's returned unchanged and the secret only lasts for this process.
+*/
+func Update(value string, secret string) (string, error) {
+	Register(secret)
+	switch {
+	case strings.HasPrefix(value, REF_ENV):
+		return value, nil
+	case strings.HasPrefix(value, REF_FILE):
+		err := os.WriteFile(strings.TrimPrefix(value, REF_FILE), []byte(secret+"\n"), 0o600)
+		if err != nil {
+			return value, fmt.Errorf("unable to update secret %s: %v", value, err)
+		}
+		return value, nil
+	}
+	return secret, nil
+}
+
+// remembers a secret for Redact, along with the forms it takes when escaped in a URL, unless it's shorter than MIN_LENGTH
+func Register(secret string) {
+	if len(secret) < MIN_LENGTH {
+		return
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	for _, s := range []string{secret, url.QueryEscape(secret), url.PathEscape(secret)} {
+		if !slices.Contains(known, s) {
+			known = append(known, s)
+		}
+	}
+	// longest first so a secret containing another is redacted whole
+	slices.SortFunc(known, func(a string, b string) int { return len(b) - len(a) })
+}
+
+// s with every registered secret replaced by [REDACTED]
+func Redact(s string) string {
+	lock.RLock()
+	defer lock.RUnlock()
+	for _, secret := range known {
+		s = strings.ReplaceAll(s, secret, REDACTED)
+	}
+	return s
+}
+
+// an error with the same message, redacted, for errors that leave the process through logs, runs or spans
+func RedactError(err error) error {
+	if err == nil {
+		return nil
+	}
+	message := err.Error()
+	if redacted := Redact(message); redacted != message {
+		return redactedError{redacted, err}
+	}
+	return err
+}
+
+type redactedError struct {
+	message string
+	err     error
+}
+
+func (e redactedError) Error() string {
+	return e.message
+}
+
+func (e redactedError) Unwrap() error {
+	return e.err
+}
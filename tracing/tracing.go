@@ -0,0 +1,84 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/BushSchoolIT/extractor/secrets"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// spans are sent over OTLP/HTTP, configured with the standard OTEL_EXPORTER_OTLP_* environment variables
+	EXPORTER_OTLP string = "otlp"
+	// spans are appended to a local file as JSON, one object per span, no collector needed
+	EXPORTER_FILE string = "file"
+)
+
+// spans go to a no-op provider until Setup installs an exporter
+var tracer = otel.Tracer("github.com/BushSchoolIT/extractor")
+
+// starts a span as a child of the one in ctx
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// ends span, marking it failed when err is set
+func End(span trace.Span, err error) {
+	if err != nil {
+		err = secrets.RedactError(err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+/*
+Installs the exporter spans are sent to, "" leaves tracing off. The returned function flushes and
+stops it and must be called before exiting or the last spans are lost.
+*/
+func Setup(exporter string, file string) (func(context.Context) error, error) {
+	var (
+		spanExporter sdktrace.SpanExporter
+		err          error
+		f            *os.File
+	)
+	switch exporter {
+	case "":
+		return func(context.Context) error { return nil }, nil
+	case EXPORTER_OTLP:
+		spanExporter, err = otlptracehttp.New(context.Background())
+	case EXPORTER_FILE:
+		f, err = os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err == nil {
+			spanExporter, err = stdouttrace.New(stdouttrace.WithWriter(f))
+		}
+	default:
+		return nil, fmt.Errorf("trace exporter must be %s or %s, got %q", EXPORTER_OTLP, EXPORTER_FILE, exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to create %s trace exporter: %v", exporter, err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", "bbextract")))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(spanExporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if f != nil {
+			f.Close()
+		}
+		return err
+	}, nil
+}